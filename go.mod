@@ -2,4 +2,7 @@ module kdlc
 
 go 1.22.0
 
-require github.com/sblinch/kdl-go v0.0.0-20240410000746-21754ba9ac55 // indirect
+require (
+	github.com/expr-lang/expr v1.17.8
+	github.com/sblinch/kdl-go v0.0.0-20240410000746-21754ba9ac55
+)
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/expr-lang/expr"
 	"github.com/sblinch/kdl-go"
 	"github.com/sblinch/kdl-go/document"
 )
@@ -32,6 +50,11 @@ func TestConvertValue(t *testing.T) {
 			value:    &document.Value{Value: int64(42)},
 			expected: int64(42),
 		},
+		{
+			name:     "typed string value",
+			value:    &document.Value{Value: "5m", Type: "duration"},
+			expected: "(duration)5m",
+		},
 		{
 			name:     "nil value",
 			value:    nil,
@@ -729,3 +752,4917 @@ func getMapKeys(m map[string]interface{}) []string {
 	}
 	return keys
 }
+
+// Test @defaults blocks provided by an included fragment
+func TestDefaultsBlock(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	defaultsContent := `@defaults {
+    config {
+        theme "light"
+        language "en"
+    }
+    debug false
+}`
+	if err := os.WriteFile(filepath.Join(tmpDir, "defaults.kdl"), []byte(defaultsContent), 0644); err != nil {
+		t.Fatalf("Failed to create defaults file: %v", err)
+	}
+
+	mainContent := `@include "defaults.kdl"
+
+config {
+    theme "dark"
+}`
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	if err := os.WriteFile(mainPath, []byte(mainContent), 0644); err != nil {
+		t.Fatalf("Failed to create main file: %v", err)
+	}
+
+	content, err := processIncludes(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+
+	doc, err := kdl.Parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+
+	jsonData, err := convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+
+	expectedJSON := `{
+  "config": {
+    "language": "en",
+    "theme": "dark"
+  },
+  "debug": false
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test repeated includes of the same fragment with and without -dedupe-includes
+func TestDedupeIncludes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	files := map[string]string{
+		"item.kdl": `item "sword" damage=10`,
+		"main.kdl": `@include "item.kdl"
+@include "item.kdl"`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+
+	tests := []struct {
+		name      string
+		dedupe    bool
+		wantItems int
+	}{
+		{name: "repeated include spliced twice", dedupe: false, wantItems: 2},
+		{name: "repeated include deduplicated", dedupe: true, wantItems: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dedupeIncludes = tt.dedupe
+			defer func() { dedupeIncludes = false }()
+
+			content, err := processIncludes(mainPath, newIncludeState())
+			if err != nil {
+				t.Fatalf("Failed to process includes: %v", err)
+			}
+
+			doc, err := kdl.Parse(strings.NewReader(content))
+			if err != nil {
+				t.Fatalf("Failed to parse KDL: %v", err)
+			}
+
+			if len(doc.Nodes) != tt.wantItems {
+				t.Errorf("Expected %d item nodes, got %d", tt.wantItems, len(doc.Nodes))
+			}
+		})
+	}
+}
+
+// Test -color mode selection and colorized output
+func TestColorOutput(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+
+	tests := []struct {
+		name     string
+		mode     string
+		terminal bool
+		noColor  string
+		expected bool
+	}{
+		{name: "never on terminal", mode: "never", terminal: true, expected: false},
+		{name: "auto when piped", mode: "auto", terminal: false, expected: false},
+		{name: "auto on terminal", mode: "auto", terminal: true, expected: true},
+		{name: "auto with NO_COLOR", mode: "auto", terminal: true, noColor: "1", expected: false},
+		{name: "always when piped", mode: "always", terminal: false, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", tt.noColor)
+			result, err := shouldColorize(tt.mode, tt.terminal)
+			if err != nil {
+				t.Fatalf("shouldColorize() returned error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("shouldColorize(%q, %v) = %v, expected %v", tt.mode, tt.terminal, result, tt.expected)
+			}
+		})
+	}
+
+	if _, err := shouldColorize("sometimes", true); err == nil {
+		t.Error("Expected error for invalid color mode")
+	}
+
+	colored := string(colorizeJSON([]byte(`{"name": "a:b", "count": -1.5, "ok": true, "none": null}`)))
+	for _, want := range []string{
+		colorKey + `"name"` + colorReset,
+		colorString + `"a:b"` + colorReset,
+		colorNumber + `-1.5` + colorReset,
+		colorBool + `true` + colorReset,
+		colorNull + `null` + colorReset,
+	} {
+		if !strings.Contains(colored, want) {
+			t.Errorf("Colorized output %q missing %q", colored, want)
+		}
+	}
+
+	// E2E: piped output never contains ANSI codes unless forced
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E part: %v", err)
+	}
+	for _, args := range [][]string{{}, {"-color=never"}} {
+		output, err := runKDLcWithArgs("testdata/simple.kdl", args)
+		if err != nil {
+			t.Fatalf("Failed to run kdlc with args %v: %v", args, err)
+		}
+		if strings.Contains(output, "\x1b[") {
+			t.Errorf("Expected no ANSI codes with args %v, got: %q", args, output)
+		}
+	}
+}
+
+// Test writing each top-level node to its own file
+func TestSplitDir(t *testing.T) {
+	kdlContent := `config {
+    version "1.0"
+}
+item "sword" damage=10
+item "shield" defense=5`
+
+	doc, err := kdl.Parse(strings.NewReader(kdlContent))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+
+	result, err := convertDocument(nil, doc)
+	if err != nil {
+		t.Fatalf("Failed to convert document: %v", err)
+	}
+
+	outDir := filepath.Join(t.TempDir(), "out")
+	if err := writeSplitFiles(outDir, result); err != nil {
+		t.Fatalf("Failed to write split files: %v", err)
+	}
+
+	expected := map[string]string{
+		"config.json": `{"version": "1.0"}`,
+		"item.json":   `[{"arg1": "sword", "damage": 10}, {"arg1": "shield", "defense": 5}]`,
+	}
+
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatalf("Failed to read output directory: %v", err)
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Expected %d files, got %d", len(expected), len(entries))
+	}
+
+	for filename, expectedJSON := range expected {
+		content, err := os.ReadFile(filepath.Join(outDir, filename))
+		if err != nil {
+			t.Errorf("Expected file %s: %v", filename, err)
+			continue
+		}
+		if !jsonEqualString(expectedJSON, string(content)) {
+			t.Errorf("Content mismatch for %s:\nExpected: %s\nActual: %s", filename, expectedJSON, string(content))
+		}
+	}
+}
+
+// Test RFC 8785 canonical JSON output
+func TestCanonicalJSON(t *testing.T) {
+	// Two semantically equal documents written differently
+	documents := []string{
+		`config version=1.0 name="app" {
+    limit 100
+    ratio 0.5
+}`,
+		`config name="app"     version=1.00 {
+    ratio 5e-1
+    limit 1e2
+}`,
+	}
+
+	var outputs []string
+	for _, kdlContent := range documents {
+		doc, err := kdl.Parse(strings.NewReader(kdlContent))
+		if err != nil {
+			t.Fatalf("Failed to parse KDL: %v", err)
+		}
+		result, err := convertDocument(nil, doc)
+		if err != nil {
+			t.Fatalf("Failed to convert document: %v", err)
+		}
+		canonical, err := canonicalJSON(result)
+		if err != nil {
+			t.Fatalf("Failed to canonicalize: %v", err)
+		}
+		outputs = append(outputs, string(canonical))
+	}
+
+	expected := `{"config":{"limit":100,"name":"app","ratio":0.5,"version":1}}`
+	for i, output := range outputs {
+		if output != expected {
+			t.Errorf("Document %d canonical output mismatch:\nExpected: %s\nActual: %s", i, expected, output)
+		}
+	}
+
+	// Number formatting follows ECMAScript rules
+	numbers := map[float64]string{
+		0:                "0",
+		-1.5:             "-1.5",
+		1e21:             "1e+21",
+		1e20:             "100000000000000000000",
+		0.000001:         "0.000001",
+		1e-7:             "1e-7",
+		123.456:          "123.456",
+		4.5e-10:          "4.5e-10",
+		1.25e+30:         "1.25e+30",
+		9007199254740992: "9007199254740992",
+	}
+	for value, want := range numbers {
+		got, err := formatCanonicalNumber(value)
+		if err != nil {
+			t.Errorf("formatCanonicalNumber(%v) returned error: %v", value, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("formatCanonicalNumber(%v) = %q, expected %q", value, got, want)
+		}
+	}
+
+	// Only required characters are escaped, and keys sort by UTF-16 code units
+	canonical, err := canonicalJSON(map[string]interface{}{
+		"\ufb01":     "<a&b>\n",
+		"\U0001F600": 1,
+		"a":          " ",
+	})
+	if err != nil {
+		t.Fatalf("Failed to canonicalize: %v", err)
+	}
+	expected = "{\"a\":\" \",\"\U0001F600\":1,\"\ufb01\":\"<a&b>\\n\"}"
+	if string(canonical) != expected {
+		t.Errorf("Canonical output mismatch:\nExpected: %s\nActual: %s", expected, string(canonical))
+	}
+}
+
+// Test environment variable expansion in include paths
+func TestIncludePathVariables(t *testing.T) {
+	tmpDir := t.TempDir()
+	configDir := filepath.Join(tmpDir, "shared")
+	if err := os.Mkdir(configDir, 0755); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+
+	files := map[string]string{
+		filepath.Join(configDir, "base.kdl"): `config {
+    theme "dark"
+}`,
+		filepath.Join(tmpDir, "main.kdl"): `@include "${KDLC_TEST_CONFIG_DIR}/base.kdl"
+scene "Main"`,
+		filepath.Join(tmpDir, "unset.kdl"): `@include "${KDLC_TEST_UNSET_DIR}/base.kdl"`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+
+	t.Setenv("KDLC_TEST_CONFIG_DIR", configDir)
+	os.Unsetenv("KDLC_TEST_UNSET_DIR")
+
+	content, err := processIncludes(filepath.Join(tmpDir, "main.kdl"), newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+
+	doc, err := kdl.Parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+
+	jsonData, err := convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+
+	expectedJSON := `{"config": {"theme": "dark"}, "scene": "Main"}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+
+	// Undefined variables are reported instead of expanding to an empty path
+	_, err = processIncludes(filepath.Join(tmpDir, "unset.kdl"), newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), "KDLC_TEST_UNSET_DIR") {
+		t.Errorf("Expected undefined variable error, got: %v", err)
+	}
+}
+
+// Test -omit-empty pruning with and without -keep-empty-arrays
+func TestOmitEmpty(t *testing.T) {
+	newInput := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name":  "app",
+			"none":  nil,
+			"empty": map[string]interface{}{},
+			"list":  []interface{}{},
+			"nested": map[string]interface{}{
+				"flag":  false,
+				"gone":  nil,
+				"items": []interface{}{},
+				"inner": map[string]interface{}{"null": nil},
+			},
+			"values": []interface{}{nil, map[string]interface{}{"x": nil, "y": 1}},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		omitEmpty       bool
+		keepEmptyArrays bool
+		expectedJSON    string
+	}{
+		{
+			name:      "pruning disabled",
+			omitEmpty: false,
+			expectedJSON: `{
+  "name": "app",
+  "none": null,
+  "empty": {},
+  "list": [],
+  "nested": {"flag": false, "gone": null, "items": [], "inner": {"null": null}},
+  "values": [null, {"x": null, "y": 1}]
+}`,
+		},
+		{
+			name:      "omit everything empty",
+			omitEmpty: true,
+			expectedJSON: `{
+  "name": "app",
+  "nested": {"flag": false},
+  "values": [null, {"y": 1}]
+}`,
+		},
+		{
+			name:            "keep empty arrays",
+			omitEmpty:       true,
+			keepEmptyArrays: true,
+			expectedJSON: `{
+  "name": "app",
+  "list": [],
+  "nested": {"flag": false, "items": []},
+  "values": [null, {"y": 1}]
+}`,
+		},
+		{
+			name:            "keep empty arrays alone has no effect",
+			keepEmptyArrays: true,
+			expectedJSON: `{
+  "name": "app",
+  "none": null,
+  "empty": {},
+  "list": [],
+  "nested": {"flag": false, "gone": null, "items": [], "inner": {"null": null}},
+  "values": [null, {"x": null, "y": 1}]
+}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			omitEmpty = tt.omitEmpty
+			keepEmptyArrays = tt.keepEmptyArrays
+			defer func() {
+				omitEmpty = false
+				keepEmptyArrays = false
+			}()
+
+			jsonData, err := json.Marshal(postProcess(newInput()))
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if !jsonEqualString(tt.expectedJSON, string(jsonData)) {
+				t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", tt.expectedJSON, string(jsonData))
+			}
+		})
+	}
+}
+
+// Test the configurable metadata key prefix
+func TestMetaPrefix(t *testing.T) {
+	defer func() {
+		metaPrefix = "_"
+		warnOutput = os.Stderr
+		warnedMetaKeys = make(map[string]bool)
+	}()
+
+	if key := metaKey("type"); key != "_type" {
+		t.Errorf("metaKey() with default prefix = %q, expected %q", key, "_type")
+	}
+
+	metaPrefix = "$"
+	if key := metaKey("type"); key != "$type" {
+		t.Errorf("metaKey() with custom prefix = %q, expected %q", key, "$type")
+	}
+
+	// Real keys using the prefix produce a single warning each
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+
+	doc, err := kdl.Parse(strings.NewReader(`item "a" $ref="x" "_private"=1
+item "b" $ref="y"`))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+	if _, err := convertDocument(nil, doc); err != nil {
+		t.Fatalf("Failed to convert document: %v", err)
+	}
+
+	output := warnings.String()
+	if strings.Count(output, `"$ref"`) != 1 {
+		t.Errorf("Expected exactly one warning for $ref, got: %q", output)
+	}
+	if strings.Contains(output, "_private") {
+		t.Errorf("Unexpected warning for key without the configured prefix: %q", output)
+	}
+}
+
+// Test NaN and infinite numbers are rejected with a clear per-node error
+func TestNonFiniteNumbers(t *testing.T) {
+	// The parser doesn't produce non-finite floats, so build the document directly
+	newDocument := func() *document.Document {
+		node := document.NewNode()
+		node.SetName("sensor")
+		node.AddProperty("reading", math.Inf(1), "")
+		scene := document.NewNode()
+		scene.SetName("scene")
+		scene.AddNode(node)
+		return &document.Document{Nodes: []*document.Node{scene}}
+	}
+
+	_, err := convertDocument(nil, newDocument())
+	if err == nil {
+		t.Fatal("Expected error for infinite number, got none")
+	}
+	for _, want := range []string{"scene.sensor", "reading", "non-finite"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got: %v", want, err)
+		}
+	}
+
+	allowNonFinite = true
+	defer func() { allowNonFinite = false }()
+
+	jsonData, err := convertKDLToJSON(newDocument())
+	if err != nil {
+		t.Fatalf("Expected no error with -allow-nonfinite, got: %v", err)
+	}
+	expectedJSON := `{"scene": {"sensor": {"reading": null}}}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -list-includes reports the full transitive include set
+func TestListIncludes(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmpDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+
+	files := map[string]string{
+		"main.kdl":      "@include \"b.kdl\"\n@include \"sub/a.kdl\"\nmain \"value\"",
+		"b.kdl":         `b "value"`,
+		"sub/a.kdl":     "@include \"c.kdl\"\na \"value\"",
+		"sub/c.kdl":     "@include \"../b.kdl\"\nc \"value\"",
+		"unrelated.kdl": `unrelated "value"`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	result, err := listIncludes(filepath.Join(tmpDir, "main.kdl"))
+	if err != nil {
+		t.Fatalf("Failed to list includes: %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(tmpDir, "b.kdl"),
+		filepath.Join(tmpDir, "main.kdl"),
+		filepath.Join(tmpDir, "sub", "a.kdl"),
+		filepath.Join(tmpDir, "sub", "c.kdl"),
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("listIncludes() = %v, expected %v", result, expected)
+	}
+
+	manifest := filepath.Join(tmpDir, "list.txt")
+	if err := os.WriteFile(manifest, []byte("main.kdl\nunrelated.kdl\n"), 0644); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+	result, err = listManifestIncludes(manifest)
+	if err != nil {
+		t.Fatalf("Failed to list manifest includes: %v", err)
+	}
+	expected = []string{
+		filepath.Join(tmpDir, "b.kdl"),
+		filepath.Join(tmpDir, "main.kdl"),
+		filepath.Join(tmpDir, "sub", "a.kdl"),
+		filepath.Join(tmpDir, "sub", "c.kdl"),
+		filepath.Join(tmpDir, "unrelated.kdl"),
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("listManifestIncludes() = %v, expected %v", result, expected)
+	}
+}
+
+// Test custom and built-in resolvers for type-annotated values
+func TestTypeResolvers(t *testing.T) {
+	defer func() { typeResolvers = make(map[string]typeResolver) }()
+
+	// A custom resolver converting minutes into seconds
+	registerTypeResolver("minutes", func(value *document.Value) (interface{}, error) {
+		minutes, ok := value.ResolvedValue().(int64)
+		if !ok {
+			return nil, fmt.Errorf("expected an integer, got %s", value.String())
+		}
+		return minutes * 60, nil
+	})
+
+	// The built-in duration resolver, mapped through the -resolver syntax
+	if err := applyResolverMappings([]string{"duration=duration", "since=date-time"}); err != nil {
+		t.Fatalf("Failed to apply resolver mappings: %v", err)
+	}
+
+	doc, err := kdl.Parse(strings.NewReader(`server timeout=(duration)"5m" grace=(minutes)2 since=(since)"2024-01-02T03:04:05Z" name="web"`))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+
+	jsonData, err := convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+
+	expectedJSON := `{"server": {"timeout": 300, "grace": 120, "since": 1704164645, "name": "web"}}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+
+	// Resolver failures name the type annotation
+	doc, err = kdl.Parse(strings.NewReader(`server timeout=(duration)"soon"`))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+	if _, err := convertDocument(nil, doc); err == nil || !strings.Contains(err.Error(), "(duration)") {
+		t.Errorf("Expected duration resolver error, got: %v", err)
+	}
+
+	// Unknown resolver names are rejected
+	if err := applyResolverMappings([]string{"ttl=fortnight"}); err == nil {
+		t.Error("Expected error for unknown resolver")
+	}
+}
+
+// Test -max-files caps the number of distinct files opened during include processing
+func TestMaxFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	mainContent := ""
+	for i := 1; i <= 4; i++ {
+		filename := fmt.Sprintf("part%d.kdl", i)
+		content := fmt.Sprintf("part%d \"value\"", i)
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+		// Repeated includes of the same file don't count against the limit
+		mainContent += fmt.Sprintf("@include %q\n@include %q\n", filename, filename)
+	}
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	if err := os.WriteFile(mainPath, []byte(mainContent), 0644); err != nil {
+		t.Fatalf("Failed to create main file: %v", err)
+	}
+
+	defer func() { maxFiles = 0 }()
+
+	// main.kdl plus four fragments
+	maxFiles = 5
+	if _, err := processIncludes(mainPath, newIncludeState()); err != nil {
+		t.Errorf("Expected no error at the limit, got: %v", err)
+	}
+
+	maxFiles = 3
+	_, err := processIncludes(mainPath, newIncludeState())
+	if err == nil {
+		t.Fatal("Expected error when exceeding the file limit, got none")
+	}
+	if !strings.Contains(err.Error(), "would be file 4 (limit 3)") {
+		t.Errorf("Expected error to name the count, got: %v", err)
+	}
+}
+
+// Test separate type-annotation emission for arguments and properties
+func TestKeepTypes(t *testing.T) {
+	kdlContent := `color (rgb)"ff0000" 1 alpha=(percent)50 name="red"`
+
+	tests := []struct {
+		name         string
+		keepArgs     bool
+		keepProps    bool
+		expectedJSON string
+	}{
+		{
+			name:         "types dropped",
+			expectedJSON: `{"color": {"arg1": "(rgb)ff0000", "arg2": 1, "alpha": 50, "name": "red"}}`,
+		},
+		{
+			name:         "types kept on arguments only",
+			keepArgs:     true,
+			expectedJSON: `{"color": {"arg1": {"type": "rgb", "value": "ff0000"}, "arg2": 1, "alpha": 50, "name": "red"}}`,
+		},
+		{
+			name:         "types kept on properties only",
+			keepProps:    true,
+			expectedJSON: `{"color": {"arg1": "(rgb)ff0000", "arg2": 1, "alpha": {"type": "percent", "value": 50}, "name": "red"}}`,
+		},
+		{
+			name:         "types kept everywhere",
+			keepArgs:     true,
+			keepProps:    true,
+			expectedJSON: `{"color": {"arg1": {"type": "rgb", "value": "ff0000"}, "arg2": 1, "alpha": {"type": "percent", "value": 50}, "name": "red"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepTypesArgs = tt.keepArgs
+			keepTypesProps = tt.keepProps
+			defer func() {
+				keepTypesArgs = false
+				keepTypesProps = false
+			}()
+
+			doc, err := kdl.Parse(strings.NewReader(kdlContent))
+			if err != nil {
+				t.Fatalf("Failed to parse KDL: %v", err)
+			}
+			jsonData, err := convertKDLToJSON(doc)
+			if err != nil {
+				t.Fatalf("Failed to convert to JSON: %v", err)
+			}
+			if !jsonEqualString(tt.expectedJSON, string(jsonData)) {
+				t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", tt.expectedJSON, string(jsonData))
+			}
+		})
+	}
+}
+
+// Test merging the files listed in a manifest
+func TestManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmpDir, "conf"), 0755); err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+
+	files := map[string]string{
+		"conf/base.kdl":   `config theme="dark"`,
+		"conf/items.kdl":  `item "sword" damage=10`,
+		"conf/extra.kdl":  `item "shield" defense=5`,
+		"conf/unused.kdl": `unused "value"`,
+		"list.txt": `# Build list for the game config
+conf/base.kdl
+
+conf/items.kdl
+  conf/extra.kdl
+# conf/unused.kdl
+`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	content, err := loadManifest(filepath.Join(tmpDir, "list.txt"), newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+
+	doc, err := kdl.Parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+	jsonData, err := convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+
+	expectedJSON := `{
+  "config": {"theme": "dark"},
+  "item": [
+    {"arg1": "sword", "damage": 10},
+    {"arg1": "shield", "defense": 5}
+  ]
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test partial-failure reporting when converting several files
+func TestContinueOnError(t *testing.T) {
+	tmpDir := t.TempDir()
+	goodFile := filepath.Join(tmpDir, "good.kdl")
+	brokenFile := filepath.Join(tmpDir, "broken.kdl")
+	otherFile := filepath.Join(tmpDir, "other.kdl")
+
+	files := map[string]string{
+		goodFile:   `config theme="dark"`,
+		brokenFile: `config {`,
+		otherFile:  `scene "Main"`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+	inputs := []string{goodFile, brokenFile, otherFile}
+
+	// Without -continue-on-error conversion stops at the broken file
+	results, errs := convertFiles(inputs)
+	if len(errs) != 1 || len(results) != 1 {
+		t.Errorf("Expected 1 result and 1 error, got %d results and %d errors", len(results), len(errs))
+	}
+
+	continueOnError = true
+	defer func() { continueOnError = false }()
+
+	results, errs = convertFiles(inputs)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), brokenFile) {
+		t.Errorf("Expected one error naming %s, got: %v", brokenFile, errs)
+	}
+	if _, ok := results[goodFile]; !ok {
+		t.Errorf("Expected result for %s", goodFile)
+	}
+	if _, ok := results[otherFile]; !ok {
+		t.Errorf("Expected result for %s", otherFile)
+	}
+
+	// E2E: partial output on stdout, the failure on stderr, non-zero exit
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E part: %v", err)
+	}
+	stdout, stderr, err := runKDLcCapture(append([]string{"-continue-on-error"}, inputs...))
+	if err == nil {
+		t.Error("Expected non-zero exit when a file fails")
+	}
+	if !strings.Contains(stderr, brokenFile) {
+		t.Errorf("Expected stderr to name %s, got: %s", brokenFile, stderr)
+	}
+	expectedJSON := fmt.Sprintf(`{%q: {"config": {"theme": "dark"}}, %q: {"scene": "Main"}}`, goodFile, otherFile)
+	if !jsonEqualString(expectedJSON, stdout) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, stdout)
+	}
+
+	// The -leaves and -split-dir outputs are written but still fail the run; relative names
+	// keep the split file names free of slashes
+	binary, err := filepath.Abs("./kdlc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative := []string{"good.kdl", "broken.kdl", "other.kdl"}
+	splitOut := filepath.Join(tmpDir, "split")
+	for _, args := range [][]string{{"-leaves"}, {"-split-dir", splitOut}} {
+		cmd := exec.Command(binary, append(append([]string{"-continue-on-error"}, args...), relative...)...)
+		cmd.Dir = tmpDir
+		output, err := cmd.Output()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitParse {
+			t.Errorf("%v: expected exit status %d, got %v", args, exitParse, err)
+		}
+		if args[0] == "-leaves" && !strings.Contains(string(output), "dark") {
+			t.Errorf("-leaves: expected partial output, got %q", output)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(splitOut, "good.kdl.json")); err != nil {
+		t.Errorf("-split-dir: expected partial output: %v", err)
+	}
+}
+
+// runKDLcCapture runs the compiled kdlc binary with the given arguments, returning stdout and stderr separately
+func runKDLcCapture(args []string) (string, string, error) {
+	cmd := exec.Command("./kdlc", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return strings.TrimSpace(stdout.String()), stderr.String(), err
+}
+
+// Test emitting repeated top-level nodes as a bare array
+func TestRootArray(t *testing.T) {
+	rootArray = true
+	defer func() { rootArray = false }()
+
+	tests := []struct {
+		name         string
+		kdlContent   string
+		expectedJSON string
+		wantErr      bool
+	}{
+		{
+			name: "repeated records",
+			kdlContent: `record "alice" age=30
+record "bob" age=25`,
+			expectedJSON: `[{"arg1": "alice", "age": 30}, {"arg1": "bob", "age": 25}]`,
+		},
+		{
+			name:         "single multi-argument record",
+			kdlContent:   `point 1 2`,
+			expectedJSON: `[[1, 2]]`,
+		},
+		{
+			name: "heterogeneous top level",
+			kdlContent: `record "alice"
+config theme="dark"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := convertSource(tt.kdlContent)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for heterogeneous top level, got: %v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+
+			jsonData, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if !jsonEqualString(tt.expectedJSON, string(jsonData)) {
+				t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", tt.expectedJSON, string(jsonData))
+			}
+		})
+	}
+}
+
+// Test -quiet suppresses warnings while keeping stdout intact
+func TestQuiet(t *testing.T) {
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E test: %v", err)
+	}
+
+	// A property using the metadata prefix produces a warning
+	kdlFile := filepath.Join(t.TempDir(), "test.kdl")
+	if err := os.WriteFile(kdlFile, []byte(`item "a" $ref="x"`), 0644); err != nil {
+		t.Fatalf("Failed to create test KDL file: %v", err)
+	}
+
+	expectedJSON := `{"item": {"arg1": "a", "$ref": "x"}}`
+
+	stdout, stderr, err := runKDLcCapture([]string{"-meta-prefix=$", kdlFile})
+	if err != nil {
+		t.Fatalf("Failed to run kdlc: %v", err)
+	}
+	if !strings.Contains(stderr, "Warning") {
+		t.Errorf("Expected a warning without -quiet, got stderr: %q", stderr)
+	}
+	if !jsonEqualString(expectedJSON, stdout) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, stdout)
+	}
+
+	stdout, stderr, err = runKDLcCapture([]string{"-quiet", "-meta-prefix=$", kdlFile})
+	if err != nil {
+		t.Fatalf("Failed to run kdlc: %v", err)
+	}
+	if stderr != "" {
+		t.Errorf("Expected no stderr output with -quiet, got: %q", stderr)
+	}
+	if !jsonEqualString(expectedJSON, stdout) {
+		t.Errorf("Output mismatch with -quiet:\nExpected: %s\nActual: %s", expectedJSON, stdout)
+	}
+}
+
+// Test naming arguments from a node's trailing comment
+func TestCommentArgNames(t *testing.T) {
+	kdlContent := `command "move" "player" duration=0.5 // action target
+link "http://example.com/a//b" rel="next" // url
+scene "Main" { // title
+    /- node "Hidden" x=0 // ignored
+    node "Button" x=100 y=100 // label
+    node "Label" \
+        x=200 // caption
+}
+plain "a" "b" kind="c"`
+
+	commentArgNames = true
+	defer func() { commentArgNames = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{
+  "command": {"action": "move", "target": "player", "duration": 0.5},
+  "link": {"url": "http://example.com/a//b", "rel": "next"},
+  "scene": {
+    "title": "Main",
+    "node": [
+      {"label": "Button", "x": 100, "y": 100},
+      {"arg1": "Label", "x": 200}
+    ]
+  },
+  "plain": {"arg1": "a", "arg2": "b", "kind": "c"}
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -no-escape-html keeps <, > and & as raw characters
+func TestNoEscapeHTML(t *testing.T) {
+	doc, err := kdl.Parse(strings.NewReader(`link href="/search?q=a&b=<c>"`))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+
+	jsonData, err := convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+	if !strings.Contains(string(jsonData), `\u0026`) || strings.Contains(string(jsonData), "<") {
+		t.Errorf("Expected HTML characters escaped by default, got: %s", jsonData)
+	}
+
+	noEscapeHTML = true
+	defer func() { noEscapeHTML = false }()
+
+	jsonData, err = convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+	if !strings.Contains(string(jsonData), `"/search?q=a&b=<c>"`) {
+		t.Errorf("Expected raw HTML characters with -no-escape-html, got: %s", jsonData)
+	}
+}
+
+// Test -merge-into deep-merges the document into an existing JSON file
+func TestMergeInto(t *testing.T) {
+	existingFile := filepath.Join(t.TempDir(), "existing.json")
+	existing := `{
+  "name": "app",
+  "build": 12345678901234567890,
+  "server": {"host": "localhost", "port": 80, "tls": false},
+  "tags": ["base"]
+}`
+	if err := os.WriteFile(existingFile, []byte(existing), 0644); err != nil {
+		t.Fatalf("Failed to write existing JSON: %v", err)
+	}
+
+	kdlContent := `server {
+    port 8080
+    tls true
+}
+tags "extra" "more"
+debug true`
+
+	tests := []struct {
+		name     string
+		arrays   string
+		expected string
+	}{
+		{
+			name:   "replace arrays",
+			arrays: "replace",
+			expected: `{
+  "name": "app",
+  "build": 12345678901234567890,
+  "server": {"host": "localhost", "port": 8080, "tls": true},
+  "tags": ["extra", "more"],
+  "debug": true
+}`,
+		},
+		{
+			name:   "append arrays",
+			arrays: "append",
+			expected: `{
+  "name": "app",
+  "build": 12345678901234567890,
+  "server": {"host": "localhost", "port": 8080, "tls": true},
+  "tags": ["base", "extra", "more"],
+  "debug": true
+}`,
+		},
+	}
+
+	defer func() { mergeArrays = "replace" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mergeArrays = tt.arrays
+			result, err := convertSource(kdlContent)
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+			merged, err := mergeIntoFile(existingFile, result)
+			if err != nil {
+				t.Fatalf("Failed to merge: %v", err)
+			}
+			jsonData, err := marshalJSON(merged)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if !strings.Contains(string(jsonData), "12345678901234567890") {
+				t.Errorf("Expected existing numbers to be kept verbatim, got: %s", jsonData)
+			}
+			if !jsonEqualString(tt.expected, string(jsonData)) {
+				t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", tt.expected, string(jsonData))
+			}
+		})
+	}
+}
+
+// Test leading zeros: quoted values stay strings, bare numbers are parsed as numbers
+func TestLeadingZeroNumbers(t *testing.T) {
+	kdlContent := `address zip="01234" code=01234
+zip "01234"
+count 007
+ratio 00.50`
+
+	doc, err := kdl.Parse(strings.NewReader(kdlContent))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+
+	jsonData, err := convertKDLToJSON(doc)
+	if err != nil {
+		t.Fatalf("Failed to convert to JSON: %v", err)
+	}
+
+	expectedJSON := `{
+  "address": {"zip": "01234", "code": 1234},
+  "zip": "01234",
+  "count": 7,
+  "ratio": 0.5
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -infer-schema describes field types, grouped nodes and required keys
+func TestInferSchema(t *testing.T) {
+	kdlContent := `config {
+    name "app"
+    port 8080
+    ratio 0.5
+}
+item "sword" damage=10
+item "shield" damage=2.5 defense=5`
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	jsonData, err := json.Marshal(inferSchema(result))
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "properties": {
+    "config": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string"},
+        "port": {"type": "integer"},
+        "ratio": {"type": "number"}
+      },
+      "required": ["name", "port", "ratio"]
+    },
+    "item": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "arg1": {"type": "string"},
+          "damage": {"type": "number"},
+          "defense": {"type": "integer"}
+        },
+        "required": ["arg1", "damage"]
+      }
+    }
+  },
+  "required": ["config", "item"]
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test the output shape of every combination of arguments, properties and children
+func TestNodeShapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		kdl   string
+		auto  string
+		named string
+	}{
+		{"empty", `node`, `null`, `null`},
+		{"one argument", `node "a"`, `"a"`, `{"arg1": "a"}`},
+		{"arguments", `node "a" "b"`, `["a", "b"]`, `{"arg1": "a", "arg2": "b"}`},
+		{"properties", `node x=1`, `{"x": 1}`, `{"x": 1}`},
+		{"children", `node { c 1; }`, `{"c": 1}`, `{"c": {"arg1": 1}}`},
+		{"arguments and properties", `node "a" x=1`, `{"arg1": "a", "x": 1}`, `{"arg1": "a", "x": 1}`},
+		{"arguments and children", `node "a" "b" { c 1; }`, `{"arg1": "a", "arg2": "b", "c": 1}`, `{"arg1": "a", "arg2": "b", "c": {"arg1": 1}}`},
+		{"properties and children", `node x=1 { c 1; }`, `{"x": 1, "c": 1}`, `{"x": 1, "c": {"arg1": 1}}`},
+		{"all three", `node "a" x=1 { c 1; }`, `{"arg1": "a", "x": 1, "c": 1}`, `{"arg1": "a", "x": 1, "c": {"arg1": 1}}`},
+	}
+
+	defer func() { argMode = "auto" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, expected := range map[string]string{"auto": tt.auto, "named": tt.named} {
+				argMode = mode
+				result, err := convertSource(tt.kdl)
+				if err != nil {
+					t.Fatalf("Failed to convert: %v", err)
+				}
+				jsonData, err := json.Marshal(result.(map[string]interface{})["node"])
+				if err != nil {
+					t.Fatalf("Failed to marshal: %v", err)
+				}
+				if !jsonEqualString(expected, string(jsonData)) {
+					t.Errorf("-arg-mode %s: expected %s, got %s", mode, expected, jsonData)
+				}
+			}
+		})
+	}
+}
+
+// Test -float-precision rounds floats to significant digits with stable, locale-independent output
+func TestFloatPrecision(t *testing.T) {
+	kdlContent := `value 1.23456789
+big 1234567.891
+values 0.000123456 2.5 42`
+
+	tests := []struct {
+		precision int
+		expected  string
+	}{
+		{0, `{"value":1.23456789,"big":1234567.891,"values":[0.000123456,2.5,42]}`},
+		{3, `{"value":1.23,"big":1230000,"values":[0.000123,2.5,42]}`},
+		{5, `{"value":1.2346,"big":1234600,"values":[0.00012346,2.5,42]}`},
+		{9, `{"value":1.23456789,"big":1234567.89,"values":[0.000123456,2.5,42]}`},
+	}
+
+	defer func() { floatPrecision = 0 }()
+	for _, tt := range tests {
+		floatPrecision = tt.precision
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+		jsonData, err := canonicalJSON(result)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+
+		// Formatting must be byte-for-byte reproducible, not just numerically equal
+		var expected interface{}
+		if err := json.Unmarshal([]byte(tt.expected), &expected); err != nil {
+			t.Fatalf("Invalid expectation: %v", err)
+		}
+		expectedData, err := canonicalJSON(expected)
+		if err != nil {
+			t.Fatalf("Failed to marshal expectation: %v", err)
+		}
+		if string(jsonData) != string(expectedData) {
+			t.Errorf("-float-precision %d: expected %s, got %s", tt.precision, expectedData, jsonData)
+		}
+	}
+}
+
+// Test -split-archive writes one entry per top-level node into zip and tar.gz archives
+func TestSplitArchive(t *testing.T) {
+	converted, err := convertSource(`config {
+    version "1.0"
+}
+item "sword" damage=10
+item "shield" defense=5`)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	result := converted.(map[string]interface{})
+
+	expected := map[string]string{
+		"config.json": `{"version": "1.0"}`,
+		"item.json":   `[{"arg1": "sword", "damage": 10}, {"arg1": "shield", "defense": 5}]`,
+	}
+
+	for _, name := range []string{"out.zip", "out.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), name)
+			if err := writeSplitArchive(archive, result); err != nil {
+				t.Fatalf("Failed to write archive: %v", err)
+			}
+
+			entries := make(map[string]string)
+			if strings.HasSuffix(name, ".zip") {
+				zr, err := zip.OpenReader(archive)
+				if err != nil {
+					t.Fatalf("Failed to open zip: %v", err)
+				}
+				defer zr.Close()
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatalf("Failed to open %s: %v", f.Name, err)
+					}
+					content, err := io.ReadAll(rc)
+					rc.Close()
+					if err != nil {
+						t.Fatalf("Failed to read %s: %v", f.Name, err)
+					}
+					entries[f.Name] = string(content)
+				}
+			} else {
+				file, err := os.Open(archive)
+				if err != nil {
+					t.Fatalf("Failed to open archive: %v", err)
+				}
+				defer file.Close()
+				gr, err := gzip.NewReader(file)
+				if err != nil {
+					t.Fatalf("Failed to open gzip stream: %v", err)
+				}
+				tr := tar.NewReader(gr)
+				for {
+					header, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("Failed to read tar: %v", err)
+					}
+					content, err := io.ReadAll(tr)
+					if err != nil {
+						t.Fatalf("Failed to read %s: %v", header.Name, err)
+					}
+					entries[header.Name] = string(content)
+				}
+			}
+
+			if len(entries) != len(expected) {
+				t.Errorf("Expected %d entries, got %d", len(expected), len(entries))
+			}
+			for entry, expectedJSON := range expected {
+				content, ok := entries[entry]
+				if !ok {
+					t.Errorf("Expected entry %s", entry)
+					continue
+				}
+				if !jsonEqualString(expectedJSON, content) {
+					t.Errorf("Content mismatch for %s:\nExpected: %s\nActual: %s", entry, expectedJSON, content)
+				}
+			}
+		})
+	}
+
+	if err := writeSplitArchive(filepath.Join(t.TempDir(), "out.rar"), result); err == nil {
+		t.Error("Expected an error for an unsupported archive type")
+	}
+}
+
+// Test -required reports missing top-level keys and dotted paths
+func TestRequiredPaths(t *testing.T) {
+	result, err := convertSource(`server {
+    host "localhost"
+}
+item "sword" damage=10
+item "shield"`)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	tests := []struct {
+		paths   []string
+		missing []string
+	}{
+		{[]string{"server", "server.host", "item.0.damage", "item.1"}, nil},
+		{[]string{"server", "database"}, []string{"database"}},
+		{[]string{"server.port", "item.1.damage", "item.2", "server.host.name"}, []string{"server.port", "item.1.damage", "item.2", "server.host.name"}},
+	}
+
+	for _, tt := range tests {
+		missing := missingPaths(result, tt.paths)
+		if !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("missingPaths(%v) = %v, expected %v", tt.paths, missing, tt.missing)
+		}
+	}
+}
+
+// Test -arg-type coerces arguments at a given index to a JSON type
+func TestArgTypes(t *testing.T) {
+	defer func() { argTypes = make(map[int]string) }()
+
+	if err := applyArgTypeMappings([]string{"3=float", "1=string", "4=bool"}); err != nil {
+		t.Fatalf("Failed to apply mappings: %v", err)
+	}
+
+	result, err := convertSource(`color 255 128 "0.5" "true"
+color 0 0 1 "false"`)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	expectedJSON := `{"color": [["255", 128, 0.5, true], ["0", 0, 1, false]]}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+
+	// Incompatible values are reported with their node and argument
+	_, err = convertSource(`color 255 128 "opaque"`)
+	if err == nil || !strings.Contains(err.Error(), `argument 3: cannot convert "opaque" to float`) {
+		t.Errorf("Expected a coercion error, got: %v", err)
+	}
+
+	for _, mapping := range []string{"0=int", "x=int", "3", "3=number"} {
+		if err := applyArgTypeMappings([]string{mapping}); err == nil {
+			t.Errorf("Expected an error for -arg-type %q", mapping)
+		}
+	}
+}
+
+// Test -relative-to resolves output paths against a project root instead of the working directory
+func TestRelativeTo(t *testing.T) {
+	root := t.TempDir()
+	absolute := filepath.Join(t.TempDir(), "abs.json")
+
+	relativeTo = root
+	defer func() { relativeTo = "" }()
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"out.json", filepath.Join(root, "out.json")},
+		{"build/out", filepath.Join(root, "build", "out")},
+		{absolute, absolute},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveOutputPath(tt.path); got != tt.expected {
+			t.Errorf("resolveOutputPath(%q) = %q, expected %q", tt.path, got, tt.expected)
+		}
+	}
+
+	// E2E: the output lands under the root regardless of the working directory
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E part: %v", err)
+	}
+	input := filepath.Join(root, "config.kdl")
+	if err := os.WriteFile(input, []byte(`config theme="dark"`), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	_, _, err := runKDLcCapture([]string{"-relative-to", root, "-output", "gen/config.json", input})
+	if err == nil {
+		t.Error("Expected an error when the output directory does not exist")
+	}
+	if err := os.Mkdir(filepath.Join(root, "gen"), 0755); err != nil {
+		t.Fatalf("Failed to create output directory: %v", err)
+	}
+	stdout, stderr, err := runKDLcCapture([]string{"-relative-to", root, "-output", "gen/config.json", input})
+	if err != nil {
+		t.Fatalf("kdlc failed: %v\n%s", err, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("Expected nothing on stdout with -output, got: %s", stdout)
+	}
+	content, err := os.ReadFile(filepath.Join(root, "gen", "config.json"))
+	if err != nil {
+		t.Fatalf("Expected output under %s: %v", root, err)
+	}
+	if !jsonEqualString(`{"config": {"theme": "dark"}}`, string(content)) {
+		t.Errorf("Unexpected output: %s", content)
+	}
+}
+
+// Test directory and glob includes, skipping files matched by -include-ignore patterns
+func TestIncludeIgnore(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmpDir, "conf.d"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	files := map[string]string{
+		"conf.d/10-base.kdl":      `base true`,
+		"conf.d/20-app.kdl":       `app "demo"`,
+		"conf.d/30-dev.local.kdl": `debug true`,
+		"conf.d/notes.txt":        `not kdl`,
+		"main.kdl":                `@include "conf.d"`,
+		"glob.kdl":                `@include "conf.d/*0-*.kdl"`,
+		".kdlignore": `# machine-specific overrides
+*.local.kdl
+`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	// Without ignore patterns every .kdl file of the directory is included, in name order
+	result, err := convertFile(filepath.Join(tmpDir, "main.kdl"))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(`{"base": true, "app": "demo", "debug": true}`, string(jsonData)) {
+		t.Errorf("Unexpected output without ignore patterns: %s", jsonData)
+	}
+
+	rules, err := loadIgnoreFile(filepath.Join(tmpDir, ".kdlignore"))
+	if err != nil {
+		t.Fatalf("Failed to load ignore file: %v", err)
+	}
+	includeIgnoreRules = rules
+	defer func() { includeIgnoreRules = nil }()
+
+	for _, input := range []string{"main.kdl", "glob.kdl"} {
+		result, err := convertFile(filepath.Join(tmpDir, input))
+		if err != nil {
+			t.Fatalf("Failed to convert %s: %v", input, err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(`{"base": true, "app": "demo"}`, string(jsonData)) {
+			t.Errorf("%s: expected the .local.kdl file to be ignored, got: %s", input, jsonData)
+		}
+	}
+
+	// Negated and anchored patterns
+	includeIgnoreRules = []ignoreRule{
+		{pattern: "*.kdl"},
+		{pattern: "conf.d/20-app.kdl", negate: true, base: tmpDir},
+	}
+	result, err = convertFile(filepath.Join(tmpDir, "main.kdl"))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, _ = json.Marshal(result)
+	if !jsonEqualString(`{"app": "demo"}`, string(jsonData)) {
+		t.Errorf("Expected only the re-included file, got: %s", jsonData)
+	}
+}
+
+// Test input files with invalid UTF-8 are rejected with the file name and byte offset
+func TestInvalidUTF8(t *testing.T) {
+	tmpDir := t.TempDir()
+	badFile := filepath.Join(tmpDir, "bad.kdl")
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+	if err := os.WriteFile(badFile, []byte("name \"caf\xe9\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(mainFile, []byte("title \"ok\"\n@include \"bad.kdl\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	for _, input := range []string{badFile, mainFile} {
+		_, err := convertFile(input)
+		if err == nil {
+			t.Fatalf("%s: expected an error for invalid UTF-8", input)
+		}
+		if !strings.Contains(err.Error(), "invalid UTF-8 in "+badFile+" at byte offset 9") {
+			t.Errorf("%s: expected the file name and offset in the error, got: %v", input, err)
+		}
+	}
+
+	allowInvalidUTF8 = true
+	defer func() { allowInvalidUTF8 = false }()
+	result, err := convertFile(badFile)
+	if err != nil {
+		t.Fatalf("Expected -allow-invalid-utf8 to accept the file, got: %v", err)
+	}
+	if name := result.(map[string]interface{})["name"]; name != "caf" {
+		t.Errorf("Expected the invalid byte to be dropped, got: %q", name)
+	}
+
+	if offset := invalidUTF8Offset([]byte("héllo ✓")); offset != -1 {
+		t.Errorf("Expected valid UTF-8, got offset %d", offset)
+	}
+}
+
+// Test -stream emits the same nodes as batch conversion, one line per top-level node
+// Test the source scanner finds the same nodes as the parser in every testdata file
+func TestScanNodesMatchesParser(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.kdl"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Failed to list testdata: %v", err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		src := strings.TrimPrefix(string(data), "\ufeff")
+		doc, err := kdl.Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", file, err)
+		}
+		compareScannedNodes(t, file, src, doc.Nodes, scanNodes(src))
+	}
+}
+
+// compareScannedNodes requires infos to have the count and names of nodes, level by level
+func compareScannedNodes(t *testing.T, file, src string, nodes []*document.Node, infos []*nodeInfo) {
+	t.Helper()
+	if len(nodes) != len(infos) {
+		t.Errorf("%s: parser found %d nodes, scanner %d", file, len(nodes), len(infos))
+		return
+	}
+	for i, node := range nodes {
+		text := src[infos[i].start:]
+		if strings.HasPrefix(text, "(") {
+			text = text[strings.IndexByte(text, ')')+1:]
+		}
+		if end := strings.IndexAny(text, " \t\r\n;{"); end >= 0 {
+			text = text[:end]
+		}
+		if name := strings.Trim(text, `"`); name != node.Name.NodeNameString() {
+			t.Errorf("%s:%d: scanner found node %q, parser %q", file, infos[i].line, name, node.Name.NodeNameString())
+		}
+		compareScannedNodes(t, file, src, node.Children, infos[i].children)
+	}
+}
+
+func TestStream(t *testing.T) {
+	kdlContent := `config version="1.0" {
+    theme "dark" // trailing comment
+    /- disabled true
+}
+/- skipped "node"
+item "sword" damage=10; item "shield" defense=5
+(special)scene "Main" {
+    title "Main Scene"
+}
+multi \
+    "a" "b"
+raw r#"a "quoted" } value"#`
+
+	var buf bytes.Buffer
+	if err := streamSource(kdlContent, nil, &buf); err != nil {
+		t.Fatalf("Failed to stream: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	doc, err := kdl.Parse(strings.NewReader(kdlContent))
+	if err != nil {
+		t.Fatalf("Failed to parse KDL: %v", err)
+	}
+	if len(lines) != len(doc.Nodes) {
+		t.Fatalf("Expected %d lines, got %d:\n%s", len(doc.Nodes), len(lines), buf.String())
+	}
+
+	// Each streamed line matches the batch conversion of the same node
+	for i, node := range doc.Nodes {
+		batch, err := convertNodeList(nil, []*document.Node{node})
+		if err != nil {
+			t.Fatalf("Failed to convert node %d: %v", i, err)
+		}
+		expected, _ := json.Marshal(batch)
+		if !jsonEqualString(string(expected), lines[i]) {
+			t.Errorf("Line %d mismatch:\nExpected: %s\nActual: %s", i+1, expected, lines[i])
+		}
+	}
+
+	// @defaults is recognized by the parsed name, type annotation or not
+	for _, source := range []string{"@defaults { a 1; }\nx 2", "x 2\n(t)@defaults { a 1; }"} {
+		if err := streamSource(source, nil, &buf); err == nil || !strings.Contains(err.Error(), "@defaults is not supported") {
+			t.Errorf("%q: expected an error for @defaults in stream mode, got %v", source, err)
+		}
+	}
+	buf.Reset()
+	if err := streamSource("@defaults_extra 1", nil, &buf); err != nil || strings.TrimSpace(buf.String()) != `{"@defaults_extra":1}` {
+		t.Errorf("Expected @defaults_extra to stream as a plain node, got %v: %s", err, buf.String())
+	}
+}
+
+// Test streamed nodes keep the file and line they came from
+func TestStreamOrigins(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+	partFile := filepath.Join(tmpDir, "part.kdl")
+	if err := os.WriteFile(mainFile, []byte("title \"Demo\" lang=\"en\"\n@include \"part.kdl\"\nfooter year=2024\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partFile, []byte("item \"sword\" damage=10\nitem big=99999999999999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, origins, err := includeSource(mainFile, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+
+	withSource = true
+	defer func() { withSource = false }()
+	var buf bytes.Buffer
+	if err := streamSource(data, origins, &buf); err != nil {
+		t.Fatalf("Failed to stream: %v", err)
+	}
+	expected := []string{
+		fmt.Sprintf(`{"title": {"arg1": "Demo", "lang": "en", "_source": %q}}`, mainFile),
+		fmt.Sprintf(`{"item": {"arg1": "sword", "damage": 10, "_source": %q}}`, partFile),
+		fmt.Sprintf(`{"item": {"big": "99999999999999999999", "_source": %q}}`, partFile),
+		fmt.Sprintf(`{"footer": {"year": 2024, "_source": %q}}`, mainFile),
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got:\n%s", len(expected), buf.String())
+	}
+	for i := range expected {
+		if !jsonEqualString(expected[i], lines[i]) {
+			t.Errorf("Line %d mismatch:\nExpected: %s\nActual: %s", i+1, expected[i], lines[i])
+		}
+	}
+
+	// Errors name the included file, not the line of the expanded source
+	failOnUnknownType = true
+	defer func() { failOnUnknownType = false }()
+	err = streamSource(data, origins, &buf)
+	if err == nil || !strings.Contains(err.Error(), "node at "+partFile+":2") {
+		t.Errorf("Expected an error at %s:2, got %v", partFile, err)
+	}
+}
+
+// Test -dedup-arrays removes structurally equal grouped nodes, keeping the first occurrence
+func TestDedupArrays(t *testing.T) {
+	kdlContent := `tag "x"
+tag "y"
+tag "x"
+item "sword" { stats damage=10 { tags "a" "b"; }; }
+item "shield"
+item "sword" { stats damage=10 { tags "a" "b"; }; }
+item "sword" { stats damage=10 { tags "b" "a"; }; }
+point 1 2
+point 1 2`
+
+	dedupArrays = true
+	defer func() { dedupArrays = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{
+  "tag": ["x", "y"],
+  "item": [
+    {"arg1": "sword", "stats": {"damage": 10, "tags": ["a", "b"]}},
+    "shield",
+    {"arg1": "sword", "stats": {"damage": 10, "tags": ["b", "a"]}}
+  ],
+  "point": [[1, 2]]
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test including one fragment several times with different parameters
+func TestIncludeParams(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"card.kdl": `card "${id}" {
+    title "${title}"
+    footer "${footer}"
+}`,
+		"main.kdl": `@include "card.kdl" id="1" title="Hello"
+@include "card.kdl" id="2" title="Say \"hi\""`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	result, err := convertFile(filepath.Join(tmpDir, "main.kdl"))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	// References without a matching parameter are left as written
+	expectedJSON := `{
+  "card": [
+    {"arg1": "1", "title": "Hello", "footer": "${footer}"},
+    {"arg1": "2", "title": "Say \"hi\"", "footer": "${footer}"}
+  ]
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -unwrap emits the single top-level node's value and -emit-root-type records its name
+func TestUnwrapRootType(t *testing.T) {
+	unwrap = true
+	defer func() { unwrap = false }()
+
+	tests := []struct {
+		name         string
+		kdlContent   string
+		emitRootType bool
+		expectedJSON string
+		wantErr      bool
+	}{
+		{
+			name:         "unwrap",
+			kdlContent:   `config version="1.0" { theme "dark"; }`,
+			expectedJSON: `{"version": "1.0", "theme": "dark"}`,
+		},
+		{
+			name:         "record name",
+			kdlContent:   `config version="1.0" { theme "dark"; }`,
+			emitRootType: true,
+			expectedJSON: `{"version": "1.0", "theme": "dark", "_root": "config"}`,
+		},
+		{
+			name:         "record name and type",
+			kdlContent:   `(settings)config version="1.0"`,
+			emitRootType: true,
+			expectedJSON: `{"version": "1.0", "_root": "config", "_type": "settings"}`,
+		},
+		{
+			name:         "scalar value",
+			kdlContent:   `version "1.0"`,
+			emitRootType: true,
+			expectedJSON: `"1.0"`,
+		},
+		{
+			name:       "several top-level nodes",
+			kdlContent: "a 1\nb 2",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emitRootType = tt.emitRootType
+			defer func() { emitRootType = false }()
+
+			var warnings bytes.Buffer
+			warnOutput = &warnings
+			defer func() { warnOutput = os.Stderr }()
+
+			result, err := convertSource(tt.kdlContent)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got: %v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+			jsonData, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if !jsonEqualString(tt.expectedJSON, string(jsonData)) {
+				t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", tt.expectedJSON, string(jsonData))
+			}
+		})
+	}
+}
+
+// Test that keys come out sorted at every level, whatever the source order, and that the
+// bytes are identical between runs
+func TestKeyOrder(t *testing.T) {
+	kdlContent := `window "Main" zeta=1 width=800 animate=true {
+    zoom 1
+    border 2 style="solid" color="red"
+    anchor "top"
+}
+app version=2`
+
+	expected := `{
+  "app": {
+    "version": 2
+  },
+  "window": {
+    "anchor": "top",
+    "animate": true,
+    "arg1": "Main",
+    "border": {
+      "arg1": 2,
+      "color": "red",
+      "style": "solid"
+    },
+    "width": 800,
+    "zeta": 1,
+    "zoom": 1
+  }
+}`
+	for i := 0; i < 20; i++ {
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+		jsonData, err := marshalJSON(result)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if string(jsonData) != expected {
+			t.Fatalf("Expected sorted keys:\n%s\nActual:\n%s", expected, jsonData)
+		}
+	}
+
+	// Canonical output orders by UTF-16 code units, which puts U+1F600 (a surrogate pair)
+	// before U+E000 where a byte-wise sort would not
+	result, err := convertSource("node \"\U0001F600\"=1 \"\uE000\"=2 b=3 a=4")
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := canonicalJSON(result)
+	if err != nil {
+		t.Fatalf("Failed to canonicalize: %v", err)
+	}
+	if expected := "{\"node\":{\"a\":4,\"b\":3,\"\U0001F600\":1,\"\uE000\":2}}"; string(jsonData) != expected {
+		t.Errorf("Expected %s, got %s", expected, jsonData)
+	}
+
+	// E2E: separate runs produce the same bytes
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E part: %v", err)
+	}
+	input := filepath.Join(t.TempDir(), "window.kdl")
+	if err := os.WriteFile(input, []byte(kdlContent), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		stdout, stderr, err := runKDLcCapture([]string{input})
+		if err != nil {
+			t.Fatalf("kdlc failed: %v, stderr: %s", err, stderr)
+		}
+		if stdout != expected {
+			t.Fatalf("Run %d: expected:\n%s\nActual:\n%s", i, expected, stdout)
+		}
+	}
+}
+
+// Test -collapse-single-child replaces single-child wrappers with the child's value
+func TestCollapseSingleChild(t *testing.T) {
+	kdlContent := `wrapper {
+    value "x"
+}
+nested {
+    outer {
+        inner 1 2
+    }
+}
+list {
+    item 1
+    item 2
+}
+labeled "a" {
+    value "y"
+}
+mixed {
+    value "z"
+    other true
+}`
+
+	collapseSingleChild = true
+	defer func() { collapseSingleChild = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	// Duplicate children, arguments and several children prevent collapsing
+	expectedJSON := `{
+  "wrapper": "x",
+  "nested": [1, 2],
+  "list": {"item": [1, 2]},
+  "labeled": {"arg1": "a", "value": "y"},
+  "mixed": {"value": "z", "other": true}
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -cache-dir reuses expanded files until one of their dependencies changes
+func TestIncludeCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	partPath := filepath.Join(tmpDir, "part.kdl")
+	if err := os.WriteFile(mainPath, []byte("@include \"part.kdl\"\nmain true"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(partPath, []byte(`part 1`), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	cacheDir = filepath.Join(tmpDir, "cache")
+	defer func() { cacheDir = "" }()
+
+	// The first run populates one entry per expanded file
+	content, err := processIncludes(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	if content != "part 1\nmain true" {
+		t.Fatalf("Unexpected content: %q", content)
+	}
+	entries, err := filepath.Glob(filepath.Join(cacheDir, "*.json"))
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 cache entries, got %v (%v)", entries, err)
+	}
+
+	// Mark the cached entries so a cache hit is observable
+	for _, path := range entries {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read cache entry: %v", err)
+		}
+		var entry includeCacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatalf("Invalid cache entry %s: %v", path, err)
+		}
+		entry.Content = "cached " + entry.Content
+		if err := writeIncludeCache(path, entry); err != nil {
+			t.Fatalf("Failed to rewrite cache entry: %v", err)
+		}
+	}
+
+	state := newIncludeState()
+	content, err = processIncludes(mainPath, state)
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	if content != "cached part 1\nmain true" {
+		t.Errorf("Expected the cached expansion, got: %q", content)
+	}
+	if !state.seen[partPath] {
+		t.Error("Expected a cache hit to record the included files")
+	}
+
+	// Changing an included file invalidates the entries that depend on it
+	if err := os.WriteFile(partPath, []byte(`part 22`), 0644); err != nil {
+		t.Fatalf("Failed to update test file: %v", err)
+	}
+	content, err = processIncludes(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	if content != "part 22\nmain true" {
+		t.Errorf("Expected a fresh expansion after the change, got: %q", content)
+	}
+}
+
+// Test -normalize-bools converts only exact boolean strings
+func TestNormalizeBools(t *testing.T) {
+	kdlContent := `settings enabled="true" disabled="false" answer="yes" refusal="no" fuzzy="truthy" upper="True" typed=(flag)"true" real=true`
+
+	tests := []struct {
+		name     string
+		yesNo    bool
+		expected string
+	}{
+		{
+			name:     "true and false",
+			expected: `{"settings": {"enabled": true, "disabled": false, "answer": "yes", "refusal": "no", "fuzzy": "truthy", "upper": "True", "typed": "(flag)true", "real": true}}`,
+		},
+		{
+			name:     "yes and no",
+			yesNo:    true,
+			expected: `{"settings": {"enabled": true, "disabled": false, "answer": true, "refusal": false, "fuzzy": "truthy", "upper": "True", "typed": "(flag)true", "real": true}}`,
+		},
+	}
+
+	normalizeBools = true
+	defer func() { normalizeBools = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalizeYesNo = tt.yesNo
+			defer func() { normalizeYesNo = false }()
+
+			result, err := convertSource(kdlContent)
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+			jsonData, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if !jsonEqualString(tt.expected, string(jsonData)) {
+				t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", tt.expected, string(jsonData))
+			}
+		})
+	}
+}
+
+// Test -max-properties rejects nodes with too many properties, naming the node
+func TestMaxProperties(t *testing.T) {
+	kdlContent := `config {
+    server host="localhost" port=8080
+    widget a=1 b=2 c=3 d=4
+}`
+
+	maxProperties = 3
+	defer func() { maxProperties = 0 }()
+
+	_, err := convertSource(kdlContent)
+	if err == nil {
+		t.Fatal("Expected an error for a node over the property limit")
+	}
+	if !strings.Contains(err.Error(), "node config.widget: 4 properties exceeds the limit of 3") {
+		t.Errorf("Expected the error to name the node, got: %v", err)
+	}
+
+	maxProperties = 4
+	if _, err := convertSource(kdlContent); err != nil {
+		t.Errorf("Expected nodes at the limit to pass, got: %v", err)
+	}
+}
+
+// Test -include-directive replaces the @include token
+func TestIncludeDirective(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"part.kdl": `part "included"`,
+		"main.kdl": `!import "part.kdl"
+@include "missing.kdl"
+main true`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	includeDirective = "!import"
+	defer func() { includeDirective = "@include" }()
+
+	content, err := processIncludes(filepath.Join(tmpDir, "main.kdl"), newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+
+	// Only the configured token is treated as a directive
+	expected := `part "included"
+@include "missing.kdl"
+main true`
+	if content != expected {
+		t.Errorf("Expected:\n%s\nActual:\n%s", expected, content)
+	}
+}
+
+// Test -no-trailing-newline controls the final byte of the output
+func TestTrailingNewline(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputFile = filepath.Join(tmpDir, "out.json")
+	defer func() { outputFile = "" }()
+	defer func() { noTrailingNewline = false }()
+
+	for _, noNewline := range []bool{false, true} {
+		noTrailingNewline = noNewline
+		if err := writeOutput([]byte(`{"a": 1}`)); err != nil {
+			t.Fatalf("Failed to write output: %v", err)
+		}
+		content, err := os.ReadFile(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		expected := `{"a": 1}`
+		if !noNewline {
+			expected += "\n"
+		}
+		if string(content) != expected {
+			t.Errorf("-no-trailing-newline=%v: expected %q, got %q", noNewline, expected, content)
+		}
+
+		// Split files follow the same setting
+		files, err := splitFiles(map[string]interface{}{"a": 1})
+		if err != nil {
+			t.Fatalf("Failed to split: %v", err)
+		}
+		if strings.HasSuffix(string(files[0].data), "\n") == noNewline {
+			t.Errorf("-no-trailing-newline=%v: unexpected split file ending %q", noNewline, files[0].data)
+		}
+	}
+}
+
+// Test -types-sidecar collects node type annotations at mirrored paths
+func TestTypesSidecar(t *testing.T) {
+	kdlContent := `(entity)player "hero" {
+    (vec2)position 1 2
+    name "Hero"
+}
+(color)background "#000"
+item "sword"
+(weapon)item "axe"
+plain 1`
+
+	typesSidecar = true
+	defer func() { typesSidecar = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{
+  "player": {"arg1": "hero", "position": [1, 2], "name": "Hero"},
+  "background": "#000",
+  "item": ["sword", "axe"],
+  "plain": 1,
+  "_types": {
+    "player": {"_type": "entity", "position": "vec2"},
+    "background": "color",
+    "item": [null, "weapon"]
+  }
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test that the types sidecar follows options that change which nodes are output where
+func TestTypesSidecarShapeOptions(t *testing.T) {
+	typesSidecar = true
+	defer func() {
+		typesSidecar = false
+		noGroup = false
+		schemaNodeName = ""
+	}()
+
+	tests := []struct {
+		name     string
+		setup    func()
+		input    string
+		expected string
+	}{
+		{
+			name:     "no-group keeps the last node",
+			setup:    func() { noGroup = true },
+			input:    "(px)a 1\n(em)a 2\n(v)b { (px)c 1; (em)c 2; }",
+			expected: `{"a": 2, "b": {"c": 2}, "_types": {"a": "em", "b": {"_type": "v", "c": "em"}}}`,
+		},
+		{
+			name:     "schema-node moves out of the body",
+			setup:    func() { schemaNodeName = "version" },
+			input:    "(schema)version 2\n(px)width 10",
+			expected: `{"width": 10, "_schema": 2, "_types": {"width": "px", "_schema": "schema"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			noGroup, schemaNodeName = false, ""
+			tt.setup()
+			result, err := convertSource(tt.input)
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+			jsonData, _ := json.Marshal(result)
+			if !jsonEqualString(tt.expected, string(jsonData)) {
+				t.Errorf("Expected: %s\nActual: %s", tt.expected, jsonData)
+			}
+		})
+	}
+}
+
+// Test include processing with KDL line continuations around directives
+func TestIncludeLineContinuation(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"part.kdl": `part "included"`,
+		"main.kdl": `point 1 \
+    2
+@include "part.kdl"
+@include \
+    "part.kdl" // continued directive
+label "a" \ // comment after the continuation
+    "b"`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	result, err := convertFile(filepath.Join(tmpDir, "main.kdl"))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{"point": [1, 2], "part": ["included", "included"], "label": ["a", "b"]}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+
+	// A directive-like line that continues a node is not an include
+	groups := continuedLines([]string{`node \`, `@include "part.kdl"`, `next 1`})
+	if len(groups) != 2 || len(groups[0]) != 2 {
+		t.Errorf("Expected the continued line to stay with its node, got: %q", groups)
+	}
+}
+
+// Test -envelope wraps the plain conversion with provenance metadata
+func TestEnvelope(t *testing.T) {
+	meta, err := envelopeMeta([]string{"config.kdl"}, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("Failed to build metadata: %v", err)
+	}
+	expected := map[string]interface{}{
+		"source":       "config.kdl",
+		"generated_at": "2023-11-14T22:13:20Z",
+		"kdlc_version": version,
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("Expected %v, got %v", expected, meta)
+	}
+
+	envelopeFields = "source"
+	defer func() { envelopeFields = "source,generated_at,kdlc_version" }()
+	meta, err = envelopeMeta([]string{"a.kdl", "b.kdl"}, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to build metadata: %v", err)
+	}
+	if !reflect.DeepEqual(meta, map[string]interface{}{"source": []string{"a.kdl", "b.kdl"}}) {
+		t.Errorf("Expected only the sources, got %v", meta)
+	}
+
+	envelopeFields = "source,checksum"
+	if _, err := envelopeMeta(nil, time.Time{}); err == nil {
+		t.Error("Expected an error for an unknown envelope field")
+	}
+
+	// E2E: the data sub-object equals the plain conversion
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E part: %v", err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	input := filepath.Join("testdata", "simple.kdl")
+	plain, _, err := runKDLcCapture([]string{input})
+	if err != nil {
+		t.Fatalf("kdlc failed: %v", err)
+	}
+	wrapped, _, err := runKDLcCapture([]string{"-envelope", input})
+	if err != nil {
+		t.Fatalf("kdlc -envelope failed: %v", err)
+	}
+
+	var envelope struct {
+		Meta map[string]interface{} `json:"meta"`
+		Data json.RawMessage        `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(wrapped), &envelope); err != nil {
+		t.Fatalf("Invalid envelope: %v\n%s", err, wrapped)
+	}
+	if envelope.Meta["source"] != input || envelope.Meta["generated_at"] != "2023-11-14T22:13:20Z" || envelope.Meta["kdlc_version"] == nil {
+		t.Errorf("Unexpected metadata: %v", envelope.Meta)
+	}
+	if !jsonEqualString(plain, string(envelope.Data)) {
+		t.Errorf("Envelope data differs from the plain conversion:\nPlain: %s\nData: %s", plain, envelope.Data)
+	}
+}
+
+// Test -case-insensitive-names groups names differing only in case under the lowercase key
+func TestCaseInsensitiveNames(t *testing.T) {
+	kdlContent := `Item "sword"
+item "shield"
+ITEM "bow"
+Config {
+    Theme "dark"
+}`
+
+	caseInsensitiveNames = true
+	defer func() { caseInsensitiveNames = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{"item": ["sword", "shield", "bow"], "config": {"theme": "dark"}}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -explain-path reports the source node, argument or property behind an output value
+func TestExplainPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	scenePath := filepath.Join(tmpDir, "scene.kdl")
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	files := map[string]string{
+		scenePath: `scene "Main" {
+    title "Main Scene"
+    node "Button" x=100 y=100
+    node "Label" x=200
+}`,
+		mainPath: `config version="1.0"
+@include "scene.kdl"
+point 1 2
+@defaults {
+    theme "dark"
+}`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+
+	data, origins, err := includeSource(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"scene.node.1.x", `property x=200 of node "node" at ` + scenePath + ":4"},
+		{"scene.node.0.arg1", `argument 1 ("Button") of node "node" at ` + scenePath + ":3"},
+		{"scene.title", `node "title" at ` + scenePath + ":2"},
+		{"scene.node", `2 nodes "node", first at ` + scenePath + ":3"},
+		{"config.version", `property version="1.0" of node "config" at ` + mainPath + ":1"},
+		{"point.1", `argument 2 (2) of node "point" at ` + mainPath + ":3"},
+		{"theme", `node "theme" at ` + mainPath + ":5 (from @defaults at " + mainPath + ":4)"},
+	}
+	for _, tt := range tests {
+		explanation, err := explainPath(data, origins, tt.path)
+		if err != nil {
+			t.Errorf("explainPath(%q) failed: %v", tt.path, err)
+			continue
+		}
+		if explanation != tt.expected {
+			t.Errorf("explainPath(%q):\nExpected: %s\nActual:   %s", tt.path, tt.expected, explanation)
+		}
+	}
+
+	if _, err := explainPath(data, origins, "scene.node.x"); err == nil {
+		t.Error("Expected an error for a grouped node without an index")
+	}
+
+	// Arguments are found under the names the conversion gives them
+	namedPath := filepath.Join(tmpDir, "named.kdl")
+	named := "@argnames \"host\" \"port\"\nserver \"db\" 5432\nlink \"http://example.com\" // url"
+	if err := os.WriteFile(namedPath, []byte(named), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	data, origins, err = includeSource(namedPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	commentArgNames = true
+	defer func() { commentArgNames = false }()
+	for path, expected := range map[string]string{
+		"server.port": `argument 2 (5432) of node "server" at ` + namedPath + ":2",
+		"link.url":    `argument 1 ("http://example.com") of node "link" at ` + namedPath + ":3",
+	} {
+		explanation, err := explainPath(data, origins, path)
+		if err != nil {
+			t.Errorf("explainPath(%q) failed: %v", path, err)
+			continue
+		}
+		if explanation != expected {
+			t.Errorf("explainPath(%q):\nExpected: %s\nActual:   %s", path, expected, explanation)
+		}
+	}
+}
+
+// Test -arg-last names the final argument of every node regardless of arity
+func TestArgLast(t *testing.T) {
+	kdlContent := `p "Hello" class="intro"
+p "note" "Hi there" class="aside"
+p "a" "b" "Bye" class="outro"
+quote "Just text"`
+
+	argLastName = "body"
+	defer func() { argLastName = "" }()
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{"auto", `{
+  "p": [
+    {"body": "Hello", "class": "intro"},
+    {"arg1": "note", "body": "Hi there", "class": "aside"},
+    {"arg1": "a", "arg2": "b", "body": "Bye", "class": "outro"}
+  ],
+  "quote": "Just text"
+}`},
+		{"named", `{
+  "p": [
+    {"body": "Hello", "class": "intro"},
+    {"arg1": "note", "body": "Hi there", "class": "aside"},
+    {"arg1": "a", "arg2": "b", "body": "Bye", "class": "outro"}
+  ],
+  "quote": {"body": "Just text"}
+}`},
+	}
+
+	defer func() { argMode = "auto" }()
+	for _, tt := range tests {
+		argMode = tt.mode
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+		jsonData, err := json.Marshal(result)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("-arg-mode %s:\nExpected: %s\nActual: %s", tt.mode, tt.expected, string(jsonData))
+		}
+	}
+}
+
+// Test -warn-shape-instability flags names that are singular in a file but plural after includes
+func TestWarnShapeInstability(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"servers.kdl": `server "a"`,
+		"extra.kdl": `server "b"
+plugin "x"
+plugin "y"`,
+		"more.kdl": `plugin "z"
+plugin "w"`,
+		"main.kdl": `@include "servers.kdl"
+@include "extra.kdl"
+@include "more.kdl"
+group {
+    member "local"
+    member "local2"
+}`,
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, filename), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+	}
+
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+	warnShapeInstability = true
+	defer func() { warnShapeInstability = false }()
+
+	if _, err := convertFile(filepath.Join(tmpDir, "main.kdl")); err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	// server is an object in servers.kdl alone; plugin and member are arrays in every file
+	output := warnings.String()
+	if !strings.Contains(output, `node "server" appears once in `+filepath.Join(tmpDir, "servers.kdl")+` but 2 times after includes`) {
+		t.Errorf("Expected a warning for server, got: %q", output)
+	}
+	if strings.Count(output, "Warning:") != 1 {
+		t.Errorf("Expected exactly one warning, got: %q", output)
+	}
+}
+
+// Test -with-raw keeps the KDL source text of each value next to the converted value
+func TestWithRaw(t *testing.T) {
+	kdlContent := `color 0xff 0o17 0b101
+pixel x=1.5e0 label="hi" flag=true empty=null
+size (px)12`
+
+	withRaw = true
+	defer func() { withRaw = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	expectedJSON := `{
+  "color": [
+    {"value": 255, "raw": "0xff"},
+    {"value": 15, "raw": "0o17"},
+    {"value": 5, "raw": "0b101"}
+  ],
+  "pixel": {
+    "x": {"value": 1.5, "raw": "1.5"},
+    "label": {"value": "hi", "raw": "\"hi\""},
+    "flag": {"value": true, "raw": "true"},
+    "empty": {"value": null, "raw": "null"}
+  },
+  "size": {"value": 12, "raw": "(px)12"}
+}`
+	if !jsonEqualString(expectedJSON, string(jsonData)) {
+		t.Errorf("Output mismatch:\nExpected: %s\nActual: %s", expectedJSON, string(jsonData))
+	}
+}
+
+// Test -fail-on-unknown-type reports values that would otherwise be stringified
+func TestFailOnUnknownType(t *testing.T) {
+	kdlContent := `limits {
+    max 99999999999999999999
+}`
+
+	// By default the value is emitted as a string
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(`{"limits": {"max": "99999999999999999999"}}`, string(jsonData)) {
+		t.Errorf("Unexpected default output: %s", jsonData)
+	}
+
+	failOnUnknownType = true
+	defer func() { failOnUnknownType = false }()
+
+	_, err = convertSource(kdlContent)
+	if err == nil || !strings.Contains(err.Error(), "node limits.max: argument 1: unsupported value type *big.Int for 99999999999999999999") {
+		t.Errorf("Expected an error naming the type and node, got: %v", err)
+	}
+
+	// Any other Go type the parser might produce is rejected the same way
+	_, err = resolveValue(&document.Value{Value: struct{}{}})
+	if err == nil || !strings.Contains(err.Error(), "unsupported value type struct {}") {
+		t.Errorf("Expected an error for an unhandled type, got: %v", err)
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	kdlContent := `scene {
+    node x=100 y=200
+    node x=300 y=400
+    title "Intro"
+    tags
+}`
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	data, err := leafLines(result)
+	if err != nil {
+		t.Fatalf("Failed to render leaves: %v", err)
+	}
+
+	lines := strings.Split(string(data), "\n")
+	expected := []string{
+		`{"path":"scene.node.0.x","value":100}`,
+		`{"path":"scene.node.0.y","value":200}`,
+		`{"path":"scene.node.1.x","value":300}`,
+		`{"path":"scene.node.1.y","value":400}`,
+		`{"path":"scene.tags","value":null}`,
+		`{"path":"scene.title","value":"Intro"}`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d leaf records, got %d: %s", len(expected), len(lines), data)
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Errorf("Record %d: expected %s, got %s", i, expected[i], line)
+		}
+	}
+
+	// Empty containers are kept as leaves so their keys are not lost
+	leaves := collectLeaves(map[string]interface{}{"a": map[string]interface{}{}, "b": []interface{}{}}, "", nil)
+	if len(leaves) != 2 || leaves[0].Path != "a" || leaves[1].Path != "b" {
+		t.Errorf("Expected empty containers as leaves, got %v", leaves)
+	}
+}
+
+func TestWithSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	buttonsPath := filepath.Join(tmpDir, "buttons.kdl")
+	files := map[string]string{
+		mainPath: `app name="demo"
+button label="OK"
+@include "buttons.kdl"
+count 3`,
+		buttonsPath: `button label="Cancel"
+theme color="dark"`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+
+	withSource = true
+	defer func() { withSource = false }()
+
+	result, err := convertFile(mainPath)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	// Grouped nodes record their own files; scalar nodes are left alone
+	expected := `{
+		"app": {"name": "demo", "_source": "` + mainPath + `"},
+		"button": [
+			{"label": "OK", "_source": "` + mainPath + `"},
+			{"label": "Cancel", "_source": "` + buttonsPath + `"}
+		],
+		"theme": {"color": "dark", "_source": "` + buttonsPath + `"},
+		"count": 3
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+
+	// Without origins there is nothing to record
+	result, err = convertSource(files[mainPath])
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	if _, ok := result.(map[string]interface{})["app"].(map[string]interface{})["_source"]; ok {
+		t.Errorf("Expected no _source without include origins: %v", result)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	kdlContent := `scene "Main" version=1.5 {
+    node "Button" x=100 y=100 z=0.1 w=1e-7
+    node "Label" x=200 y=3.14159
+    title "Main Scene"
+    tags "a" "b" "c"
+}
+config debug=true level="info" ratio=0.333
+zeta 1
+alpha 2
+beta 3`
+
+	var first []byte
+	for i := 0; i < 50; i++ {
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+		jsonData, err := marshalJSON(result)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if i == 0 {
+			first = jsonData
+		} else if !bytes.Equal(first, jsonData) {
+			t.Fatalf("Run %d produced different output:\n%s\nvs\n%s", i, first, jsonData)
+		}
+	}
+
+	// With several failing nodes, the same one is always reported
+	failOnUnknownType = true
+	defer func() { failOnUnknownType = false }()
+	badContent := `first a=99999999999999999999 b=99999999999999999999
+second 99999999999999999999
+third 99999999999999999999`
+	for i := 0; i < 50; i++ {
+		_, err := convertSource(badContent)
+		if err == nil || !strings.Contains(err.Error(), "node first: property a:") {
+			t.Fatalf("Run %d: expected the first failing property to be reported, got: %v", i, err)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	kdlContent := `services {
+    database {
+        primary host="db1" port=5432 {
+            credentials user="admin" password="hunter2"
+        }
+    }
+    cache password="swordfish" host="cache1"
+}
+api_token "abc123"
+name "demo"`
+
+	redactKeys = stringList{"password", "*_token"}
+	defer func() { redactKeys = nil }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	expected := `{
+		"services": {
+			"database": {
+				"primary": {
+					"host": "db1",
+					"port": 5432,
+					"credentials": {"user": "admin", "password": "***"}
+				}
+			},
+			"cache": {"password": "***", "host": "cache1"}
+		},
+		"api_token": "***",
+		"name": "demo"
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+}
+
+func TestSchemaNode(t *testing.T) {
+	kdlContent := `(schema)version "2"
+server host="localhost" port=8080
+debug true`
+
+	schemaNodeName = "version"
+	defer func() { schemaNodeName = "" }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	expected := `{
+		"_schema": "2",
+		"server": {"host": "localhost", "port": 8080},
+		"debug": true
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+
+	// A document without the node converts as usual
+	result, err = convertSource(`debug true`)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	jsonData, _ = json.Marshal(result)
+	if !jsonEqualString(`{"debug": true}`, string(jsonData)) {
+		t.Errorf("Unexpected output without a schema node: %s", jsonData)
+	}
+
+	// The schema node must be unique
+	_, err = convertSource(kdlContent + "\nversion \"3\"")
+	if err == nil || !strings.Contains(err.Error(), `schema node "version" appears 2 times`) {
+		t.Errorf("Expected an error for a repeated schema node, got: %v", err)
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputFile = filepath.Join(tmpDir, "out.json")
+	maxOutputSize = 16
+	defer func() {
+		outputFile = ""
+		maxOutputSize = 0
+	}()
+
+	// {"a": 1} plus the trailing newline is 9 bytes
+	if err := writeOutput([]byte(`{"a": 1}`)); err != nil {
+		t.Fatalf("Expected output within the limit to be written: %v", err)
+	}
+	os.Remove(outputFile)
+
+	err := writeOutput([]byte(`{"items": [1, 2, 3, 4, 5]}`))
+	if err == nil || !strings.Contains(err.Error(), "output is 27 bytes, exceeding -max-output-size of 16") {
+		t.Errorf("Expected a size error, got: %v", err)
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written, stat returned: %v", err)
+	}
+
+	// Split files count together
+	_, err = splitFiles(map[string]interface{}{"a": "12345", "b": "12345", "c": "12345"})
+	if err == nil || !strings.Contains(err.Error(), "exceeding -max-output-size") {
+		t.Errorf("Expected a size error for split files, got: %v", err)
+	}
+}
+
+func TestIncludeOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	sharedPath := filepath.Join(tmpDir, "shared.kdl")
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	files := map[string]string{
+		sharedPath: `route "/home" handler="home"
+middleware "auth"
+route "/about" {
+    handler "about"
+}
+(internal)database host="db"`,
+		mainPath: `app "demo"
+@include-only "shared.kdl" "route"
+port 8080`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+
+	data, origins, err := includeSource(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	if count := strings.Count(data, "\n") + 1; count != len(origins) {
+		t.Errorf("Expected an origin per line, got %d lines and %d origins", count, len(origins))
+	}
+	if origins[3].File != sharedPath || origins[3].Line != 4 {
+		t.Errorf("Expected line 4 to come from %s:4, got %v", sharedPath, origins[3])
+	}
+
+	result, err := convertSource(data)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	expected := `{
+		"app": "demo",
+		"route": [
+			{"arg1": "/home", "handler": "home"},
+			{"arg1": "/about", "handler": "about"}
+		],
+		"port": 8080
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+
+	// Several names may be listed, and the directive needs at least one
+	os.WriteFile(mainPath, []byte(`@include-only "shared.kdl" "middleware" "database"`), 0644)
+	data, err = processIncludes(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	result, _ = convertSource(data)
+	jsonData, _ = json.Marshal(result)
+	if !jsonEqualString(`{"middleware": "auth", "database": {"host": "db"}}`, string(jsonData)) {
+		t.Errorf("Unexpected output for several names: %s", jsonData)
+	}
+
+	os.WriteFile(mainPath, []byte(`@include-only "shared.kdl"`), 0644)
+	_, err = processIncludes(mainPath, newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), `@include-only "shared.kdl" names no nodes to include`) {
+		t.Errorf("Expected an error without node names, got: %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	kdlContent := `srv {
+    port 8080
+    host "localhost"
+}
+item name="a"
+item name="b"`
+
+	convert := func() map[string]interface{} {
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+		return result.(map[string]interface{})
+	}
+
+	// A top-level key, a nested key, and a key inside a grouped node
+	result := convert()
+	err := renameKeys(result, []keyRename{
+		{from: "srv", to: "server"},
+		{from: "server.port", to: "listen_port"},
+		{from: "item.1.name", to: "label"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	expected := `{
+		"server": {"listen_port": 8080, "host": "localhost"},
+		"item": [{"name": "a"}, {"label": "b"}]
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+
+	// Renaming onto an existing key is rejected
+	err = renameKeys(convert(), []keyRename{{from: "srv.port", to: "host"}})
+	if err == nil || !strings.Contains(err.Error(), "cannot rename srv.port to host: the key already exists") {
+		t.Errorf("Expected a collision error, got: %v", err)
+	}
+
+	// So is a path that doesn't exist
+	err = renameKeys(convert(), []keyRename{{from: "srv.missing", to: "x"}})
+	if err == nil || !strings.Contains(err.Error(), "cannot rename srv.missing: no such key") {
+		t.Errorf("Expected a missing key error, got: %v", err)
+	}
+
+	// And mappings without a plain key name as the target
+	defer func() { renames = nil }()
+	if err := applyRenameMappings([]string{"a.b=c.d"}); err == nil {
+		t.Errorf("Expected an error for a dotted rename target")
+	}
+}
+
+func TestStringify(t *testing.T) {
+	kdlContent := `package version=1.0 build=42 debug=true {
+    size 1024
+}
+version 2.0
+mask 0xff
+code_a 7
+code_b 8
+missing null
+spelled 1e3 2.10 (n)1_000 total=1_000.50`
+
+	stringifyKeys = stringList{"version", "mask", "code_*", "missing", "spelled", "total"}
+	defer func() { stringifyKeys = nil }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	expected := `{
+		"package": {"version": "1.0", "build": 42, "debug": true, "size": 1024},
+		"version": "2.0",
+		"mask": "0xff",
+		"code_a": "7",
+		"code_b": "8",
+		"missing": null,
+		"spelled": {"arg1": "1e3", "arg2": "2.10", "arg3": "1_000", "total": "1_000.50"}
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	tmpDir := t.TempDir()
+	cardPath := filepath.Join(tmpDir, "card.kdl")
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	files := map[string]string{
+		cardPath: `card id="card-${index}" {
+    title "${title} ${index}"
+}`,
+		mainPath: `deck "demo"
+@repeat 3 "card.kdl" title="Card"`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+
+	data, origins, err := includeSource(mainPath, newIncludeState())
+	if err != nil {
+		t.Fatalf("Failed to process includes: %v", err)
+	}
+	if count := strings.Count(data, "\n") + 1; count != len(origins) {
+		t.Errorf("Expected an origin per line, got %d lines and %d origins", count, len(origins))
+	}
+
+	result, err := convertSource(data)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	expected := `{
+		"deck": "demo",
+		"card": [
+			{"id": "card-0", "title": "Card 0"},
+			{"id": "card-1", "title": "Card 1"},
+			{"id": "card-2", "title": "Card 2"}
+		]
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+
+	// The count is bounded by -max-files
+	maxFiles = 2
+	defer func() { maxFiles = 0 }()
+	_, err = processIncludes(mainPath, newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), "@repeat count 3 exceeds the -max-files limit of 2") {
+		t.Errorf("Expected a limit error, got: %v", err)
+	}
+
+	// Without -max-files, huge counts are still rejected before any copy is made
+	maxFiles = 0
+	hugePath := filepath.Join(tmpDir, "huge.kdl")
+	if err := os.WriteFile(hugePath, []byte(`@repeat 1000000000 "card.kdl" title="Card"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = processIncludes(hugePath, newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), "@repeat count 1000000000 exceeds the limit of 10000") {
+		t.Errorf("Expected the hard limit error, got: %v", err)
+	}
+}
+
+func TestStableShape(t *testing.T) {
+	stableShape = true
+	defer func() { stableShape = false }()
+
+	tests := []struct {
+		kdl      string
+		expected string
+	}{
+		// Adding a property keeps the node an object with the same keys
+		{`point 1 2`, `{"point": {"args": [1, 2], "props": {}}}`},
+		{`point 1 2 z=3`, `{"point": {"args": [1, 2], "props": {"z": 3}}}`},
+		// A single argument is still an array
+		{`title "Hello"`, `{"title": {"args": ["Hello"], "props": {}}}`},
+		// Children sit alongside args and props
+		{`scene "Main" { size 10; }`, `{"scene": {"args": ["Main"], "props": {}, "size": {"args": [10], "props": {}}}}`},
+		// Nodes without arguments are unchanged
+		{`window width=800`, `{"window": {"width": 800}}`},
+		{`empty`, `{"empty": null}`},
+	}
+	for _, tt := range tests {
+		result, err := convertSource(tt.kdl)
+		if err != nil {
+			t.Fatalf("Failed to convert %q: %v", tt.kdl, err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", tt.kdl, tt.expected, jsonData)
+		}
+	}
+
+	_, err := convertSource(`node 1 { args 2; }`)
+	if err == nil || !strings.Contains(err.Error(), `child node "args" conflicts with the -stable-shape "args" key`) {
+		t.Errorf("Expected a conflict error, got: %v", err)
+	}
+}
+
+func TestInputGlob(t *testing.T) {
+	tmpDir := t.TempDir()
+	configDir := filepath.Join(tmpDir, "configs")
+	outDir := filepath.Join(tmpDir, "out")
+	os.MkdirAll(configDir, 0755)
+	files := map[string]string{
+		"app.kdl":   `name "app"`,
+		"db.kdl":    `host "localhost" port=5432`,
+		"notes.txt": `not matched`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", name, err)
+		}
+	}
+
+	var report bytes.Buffer
+	failures, err := convertGlob(filepath.Join(configDir, "*.kdl"), outDir, &report)
+	if err != nil || failures != 0 {
+		t.Fatalf("Expected a clean batch, got %d failures, error %v:\n%s", failures, err, report.String())
+	}
+
+	entries, _ := os.ReadDir(outDir)
+	if len(entries) != 2 {
+		t.Fatalf("Expected two output files, got %d", len(entries))
+	}
+	expected := map[string]string{
+		"app.json": `{"name": "app"}`,
+		"db.json":  `{"host": {"arg1": "localhost", "port": 5432}}`,
+	}
+	for name, want := range expected {
+		content, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if !jsonEqualString(want, string(content)) {
+			t.Errorf("%s: expected %s, got %s", name, want, content)
+		}
+		if !strings.Contains(report.String(), "-> "+filepath.Join(outDir, name)) {
+			t.Errorf("Expected %s in the report:\n%s", name, report.String())
+		}
+	}
+
+	// A broken file is reported without stopping the others
+	os.WriteFile(filepath.Join(configDir, "bad.kdl"), []byte(`node {`), 0644)
+	report.Reset()
+	failures, err = convertGlob(filepath.Join(configDir, "*.kdl"), outDir, &report)
+	if err != nil || failures != 1 {
+		t.Fatalf("Expected one failure, got %d, error %v", failures, err)
+	}
+	if !strings.Contains(report.String(), "FAIL "+filepath.Join(configDir, "bad.kdl")) || strings.Count(report.String(), "ok   ") != 2 {
+		t.Errorf("Unexpected report:\n%s", report.String())
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	kdlContent := `// The main scene.
+// Shown at startup.
+scene "Main" {
+    title "Main Scene" // window title
+
+    // this is the main button
+    node "Button" x=100
+    node "Label" x=200
+
+    // detached comment
+
+    hidden false
+}
+@defaults {
+    // the UI theme
+    theme "dark"
+}`
+
+	docs, err := docComments(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to collect docs: %v", err)
+	}
+	expected := map[string]string{
+		"scene":       "The main scene.\nShown at startup.",
+		"scene.title": "window title",
+		"scene.node":  "this is the main button",
+		"theme":       "the UI theme",
+	}
+	if !reflect.DeepEqual(docs, expected) {
+		t.Errorf("Expected %v, got %v", expected, docs)
+	}
+}
+
+func TestNodeGraph(t *testing.T) {
+	kdlContent := `scene "Main" {
+    node "Button" x=100
+    title "Main Scene"
+}
+config`
+
+	graph, err := nodeGraph(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to render graph: %v", err)
+	}
+	expected := `digraph kdl {
+    n1 [label="scene"];
+    n2 [label="node"];
+    n1 -> n2;
+    n3 [label="title"];
+    n1 -> n3;
+    n4 [label="config"];
+}`
+	if graph != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, graph)
+	}
+	if !strings.Contains(graph, "n1 -> n2;") {
+		t.Errorf("Expected an edge from scene to its child node")
+	}
+
+	if quoted := dotQuote(`say "hi" \ bye`); quoted != `"say \"hi\" \\ bye"` {
+		t.Errorf("Unexpected DOT quoting: %s", quoted)
+	}
+}
+
+func TestMetaCollision(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	if err := os.WriteFile(mainPath, []byte(`asset "_source"="upstream" name="logo"`), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	withSource = true
+	warnOutput = io.Discard
+	defer func() {
+		withSource = false
+		metaCollision = "warn"
+		warnOutput = os.Stderr
+	}()
+
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{"warn", `{"asset": {"_source": "` + mainPath + `", "name": "logo"}}`},
+		{"escape", `{"asset": {"_source": "` + mainPath + `", "__source": "upstream", "name": "logo"}}`},
+	}
+	for _, tt := range tests {
+		metaCollision = tt.policy
+		result, err := convertFile(mainPath)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.policy, err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", tt.policy, tt.expected, jsonData)
+		}
+	}
+
+	metaCollision = "error"
+	_, err := convertFile(mainPath)
+	if err == nil || !strings.Contains(err.Error(), `node asset: key "_source" collides with the metadata key kdlc adds`) {
+		t.Errorf("Expected a collision error, got: %v", err)
+	}
+
+	// The same policy applies to every feature that adds metadata keys
+	schemaNodeName = "version"
+	defer func() { schemaNodeName = "" }()
+	_, err = convertSource("version 2\n\"_schema\" 1")
+	if err == nil || !strings.Contains(err.Error(), `key "_schema" collides`) {
+		t.Errorf("Expected a collision error for -schema-node, got: %v", err)
+	}
+}
+
+func TestArgCounts(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	content := `routes {
+    route "GET" "/" "home"
+    route "POST" "/login"
+    route "/broken"
+}`
+	if err := os.WriteFile(mainPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	defer func() { argCounts = make(map[string]argCountRange) }()
+	if err := applyArgCountMappings([]string{"route=2..3"}); err != nil {
+		t.Fatalf("Failed to parse -args: %v", err)
+	}
+
+	_, err := convertFile(mainPath)
+	want := "node routes.route[2]: 1 arguments at " + mainPath + ":4, expected 2 to 3"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected %q, got: %v", want, err)
+	}
+
+	// Nodes within range convert as usual
+	if _, err := convertSource(`route "GET" "/"`); err != nil {
+		t.Errorf("Expected a node within range to convert: %v", err)
+	}
+
+	tests := []struct {
+		mapping string
+		valid   bool
+	}{
+		{"point=2", true},
+		{"item=1..", true},
+		{"tag=..3", true},
+		{"bad=3..2", false},
+		{"bad=x", false},
+		{"bad=..", false},
+		{"=1", false},
+	}
+	for _, tt := range tests {
+		if err := applyArgCountMappings([]string{tt.mapping}); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got error %v", tt.mapping, tt.valid, err)
+		}
+	}
+}
+
+func TestPreserveNumberFormat(t *testing.T) {
+	kdlContent := `flags 0xff 0o17 0b1010 42
+limits max=1_000_000 ratio=1_000.5 plain=3.5 typed=(u8)0xA0
+colors {
+    red 0xFF0000
+}
+big 0xffffffffffffffffffff`
+
+	preserveNumberFormat = true
+	defer func() { preserveNumberFormat = false }()
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	expected := `{
+		"flags": ["0xff", "0o17", "0b1010", 42],
+		"limits": {"max": "1_000_000", "ratio": "1_000.5", "plain": 3.5, "typed": "0xA0"},
+		"colors": {"red": "0xFF0000"},
+		"big": "0xffffffffffffffffffff"
+	}`
+	jsonData, _ := json.Marshal(result)
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("Unexpected output: %s", jsonData)
+	}
+
+	// Without the flag the numbers resolve as usual
+	preserveNumberFormat = false
+	result, _ = convertSource(`n 0xff 1_000`)
+	jsonData, _ = json.Marshal(result)
+	if !jsonEqualString(`{"n": [255, 1000]}`, string(jsonData)) {
+		t.Errorf("Unexpected default output: %s", jsonData)
+	}
+}
+
+func TestDepFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainPath := filepath.Join(tmpDir, "main.kdl")
+	files := map[string]string{
+		mainPath:                       `@include "fragments/b.kdl"` + "\n" + `@include "a.kdl"`,
+		filepath.Join(tmpDir, "a.kdl"): `a 1`,
+		filepath.Join(tmpDir, "fragments", "b.kdl"): `@include "../my file.kdl"` + "\nb 2",
+		filepath.Join(tmpDir, "my file.kdl"):        `c 3`,
+	}
+	os.MkdirAll(filepath.Join(tmpDir, "fragments"), 0755)
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", path, err)
+		}
+	}
+
+	depPath := filepath.Join(tmpDir, "out.d")
+	if err := writeDepFile(depPath, "out.json", mainPath); err != nil {
+		t.Fatalf("Failed to write depfile: %v", err)
+	}
+	content, err := os.ReadFile(depPath)
+	if err != nil {
+		t.Fatalf("Failed to read depfile: %v", err)
+	}
+
+	// The input comes first, then the includes in sorted order
+	expected := "out.json: " + mainPath + " " +
+		filepath.Join(tmpDir, "a.kdl") + " " +
+		filepath.Join(tmpDir, "fragments", "b.kdl") + " " +
+		strings.ReplaceAll(filepath.Join(tmpDir, "my file.kdl"), " ", `\ `) + "\n"
+	if string(content) != expected {
+		t.Errorf("Expected %q, got %q", expected, content)
+	}
+
+	if err := writeDepFile(depPath, "", mainPath); err == nil {
+		t.Errorf("Expected an error without a target")
+	}
+}
+
+func TestFlattenArgs(t *testing.T) {
+	kdlContent := `server "web" port=80 {
+    route "/" handler="home"
+}
+point 1 2 z=3
+name "plain"`
+
+	flattenArgs = true
+	defer func() {
+		flattenArgs = false
+		flattenArgsKey = "value"
+	}()
+
+	for _, key := range []string{"value", "id"} {
+		flattenArgsKey = key
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+
+		// Nodes with several arguments keep the usual names, and bare values are unchanged
+		expected := `{
+			"server": {"` + key + `": "web", "port": 80, "route": {"` + key + `": "/", "handler": "home"}},
+			"point": {"arg1": 1, "arg2": 2, "z": 3},
+			"name": "plain"
+		}`
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(expected, string(jsonData)) {
+			t.Errorf("-flatten-args-key %s: unexpected output: %s", key, jsonData)
+		}
+	}
+}
+
+func TestInputGlobParallel(t *testing.T) {
+	tmpDir := t.TempDir()
+	configDir := filepath.Join(tmpDir, "configs")
+	outDir := filepath.Join(tmpDir, "out")
+	os.MkdirAll(configDir, 0755)
+	os.WriteFile(filepath.Join(configDir, "shared.inc"), []byte(`"_shared" true`), 0644)
+
+	const count = 12
+	for i := 0; i < count; i++ {
+		content := fmt.Sprintf("service \"svc%d\" port=%d {\n    @include \"shared.inc\"\n}", i, 8000+i)
+		if i == 5 {
+			content = `broken {`
+		}
+		if err := os.WriteFile(filepath.Join(configDir, fmt.Sprintf("svc%02d.kdl", i)), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	parallelJobs = 4
+	warnOutput = io.Discard
+	defer func() {
+		parallelJobs = 1
+		warnOutput = os.Stderr
+	}()
+
+	var report bytes.Buffer
+	failures, err := convertGlob(filepath.Join(configDir, "*.kdl"), outDir, &report)
+	if err != nil {
+		t.Fatalf("Failed to run batch: %v", err)
+	}
+	if failures != 1 {
+		t.Errorf("Expected one failure, got %d:\n%s", failures, report.String())
+	}
+
+	// Every other file is written with its own content, and the report keeps file order
+	var lines []string
+	for _, line := range strings.Split(report.String(), "\n") {
+		if strings.HasPrefix(line, "ok ") || strings.HasPrefix(line, "FAIL ") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != count {
+		t.Fatalf("Expected %d report lines, got %d", count, len(lines))
+	}
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("svc%02d", i)
+		if !strings.Contains(lines[i], name+".kdl") {
+			t.Errorf("Report line %d is not about %s: %s", i, name, lines[i])
+		}
+		if i == 5 {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(outDir, name+".json"))
+		if err != nil {
+			t.Fatalf("Missing output for %s: %v", name, err)
+		}
+		expected := fmt.Sprintf(`{"service": {"arg1": "svc%d", "port": %d, "_shared": true}}`, i, 8000+i)
+		if !jsonEqualString(expected, string(content)) {
+			t.Errorf("%s: expected %s, got %s", name, expected, content)
+		}
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	hashOf := func(kdlContent string) string {
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("Failed to convert: %v", err)
+		}
+		sum, err := contentHash(result)
+		if err != nil {
+			t.Fatalf("Failed to hash: %v", err)
+		}
+		return sum
+	}
+
+	first := hashOf(`server host="localhost" port=8080`)
+	if len(first) != 64 {
+		t.Errorf("Expected a hex SHA-256, got %q", first)
+	}
+
+	// Same content, written differently, hashes the same
+	if again := hashOf("server port=8080 \\\n    host=\"localhost\""); again != first {
+		t.Errorf("Expected the same hash for the same content, got %s and %s", first, again)
+	}
+
+	if changed := hashOf(`server host="localhost" port=8081`); changed == first {
+		t.Errorf("Expected a different hash for changed input")
+	}
+}
+
+func TestNumericArrays(t *testing.T) {
+	numericArrays = true
+	defer func() { numericArrays = false }()
+
+	tests := []struct {
+		name     string
+		kdl      string
+		expected string
+	}{
+		{"contiguous from zero", `steps { "0" "a"; "1" "b"; "2" "c"; }`, `{"steps": ["a", "b", "c"]}`},
+		{"written out of order", `steps { "1" "b"; "0" "a"; }`, `{"steps": ["a", "b"]}`},
+		{"no zero", `steps { "1" "a"; "2" "b"; "3" "c"; }`, `{"steps": {"\"1\"": "a", "\"2\"": "b", "\"3\"": "c"}}`},
+		{"gap", `steps { "0" "a"; "2" "b"; }`, `{"steps": {"\"0\"": "a", "\"2\"": "b"}}`},
+		{"repeated index", `steps { "0" "a"; "0" "b"; }`, `{"steps": {"\"0\"": ["a", "b"]}}`},
+		{"leading zero", `steps { "00" "a"; "1" "b"; }`, `{"steps": {"\"00\"": "a", "\"1\"": "b"}}`},
+		{"mixed names", `steps { "0" "a"; next "b"; }`, `{"steps": {"\"0\"": "a", "next": "b"}}`},
+		{"node with properties", `steps id=1 { "0" "a"; }`, `{"steps": {"id": 1, "\"0\"": "a"}}`},
+	}
+	for _, tt := range tests {
+		result, err := convertSource(tt.kdl)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, jsonData)
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	defer func() { nodeAliases = make(map[string]string) }()
+	if err := applyAliasMappings([]string{"colour=color", "col=color"}); err != nil {
+		t.Fatalf("failed to apply aliases: %v", err)
+	}
+
+	result, err := convertSource(`color "red"
+colour "blue"
+col "green"
+size 3`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{"color": ["red", "blue", "green"], "size": 3}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	if err := applyAliasMappings([]string{"colour=tint"}); err == nil {
+		t.Error("expected an error for a name aliased twice")
+	}
+	for _, mapping := range []string{"colour", "=color", "colour="} {
+		if err := applyAliasMappings([]string{mapping}); err == nil {
+			t.Errorf("expected an error for -alias %q", mapping)
+		}
+	}
+}
+
+func TestLintIndentation(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+	content := "server {\n\tport 80\n\t  host \"a\"\n    debug true\n\n\tname \"x\"\n}\n"
+	if err := os.WriteFile(mainFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	lintIndentation = true
+	defer func() {
+		warnOutput = os.Stderr
+		lintIndentation = false
+	}()
+
+	if _, err := processIncludes(mainFile, newIncludeState()); err != nil {
+		t.Fatalf("failed to process includes: %v", err)
+	}
+	file := displayPath(mainFile)
+	expected := fmt.Sprintf("Warning: %s:3: indentation mixes tabs and spaces\nWarning: %s:4: indented with spaces, but line 2 is indented with tabs\n", file, file)
+	if warnings.String() != expected {
+		t.Errorf("expected warnings %q, got %q", expected, warnings.String())
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+	partFile := filepath.Join(tmpDir, "part.kdl")
+	if err := os.WriteFile(mainFile, []byte("short 1\n@include \"part.kdl\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partFile, []byte("ok 2\ndescription \"this line is far too long for the limit\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	maxLineLength = 30
+	defer func() {
+		warnOutput = os.Stderr
+		maxLineLength = 0
+	}()
+
+	if _, err := processIncludes(mainFile, newIncludeState()); err != nil {
+		t.Fatalf("failed to process includes: %v", err)
+	}
+	expected := fmt.Sprintf("Warning: %s:2: line is 53 characters long (limit 30)\n", displayPath(partFile))
+	if warnings.String() != expected {
+		t.Errorf("expected warning %q, got %q", expected, warnings.String())
+	}
+}
+
+func TestChildrenAsList(t *testing.T) {
+	childrenAsList = true
+	defer func() { childrenAsList = false }()
+
+	result, err := convertSource(`pipeline {
+    step "build"
+    notify "team"
+    step "test"
+}
+job "deploy" retries=2 {
+    step "push"
+}
+empty`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{
+		"pipeline": [
+			{"name": "step", "value": "build"},
+			{"name": "notify", "value": "team"},
+			{"name": "step", "value": "test"}
+		],
+		"job": {"arg1": "deploy", "retries": 2, "_children": [{"name": "step", "value": "push"}]},
+		"empty": null
+	}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	result, err := convertSource(`cfg_database host="db" cfg_port=5432
+cfg_cache { cfg_size 64; }
+other 1
+cfg_ "kept"`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if err := stripKeyPrefix(result, "cfg_", ""); err != nil {
+		t.Fatalf("failed to strip prefix: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{"database": {"host": "db", "port": 5432}, "cache": {"size": 64}, "other": 1, "cfg_": "kept"}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	result, err = convertSource(`server { cfg_port 80; port 8080; }`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	err = stripKeyPrefix(result, "cfg_", "")
+	if err == nil || !strings.Contains(err.Error(), "server.cfg_port and server.port would both become server.port") {
+		t.Errorf("expected a collision error, got %v", err)
+	}
+}
+
+func TestArgNamesScope(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"main.kdl": `@argnames "label"
+title "Home"
+@include "servers.kdl"
+@include "users.kdl"
+footer "bye" year=2024`,
+		"servers.kdl": `@argnames "host" "port"
+server "db" 5432 primary=true`,
+		"users.kdl": `user "alice" admin=true
+@include "groups.kdl"`,
+		"groups.kdl": `@argnames "group"
+member "ops" since=2020`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := convertFile(filepath.Join(tmpDir, "main.kdl"))
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{
+		"title": "Home",
+		"server": {"host": "db", "port": 5432, "primary": true},
+		"user": {"label": "alice", "admin": true},
+		"member": {"group": "ops", "since": 2020},
+		"footer": {"label": "bye", "year": 2024}
+	}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	// Without a directive the global names apply
+	result, err = convertFile(filepath.Join(tmpDir, "users.kdl"))
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ = json.Marshal(result)
+	expected = `{"user": {"arg1": "alice", "admin": true}, "member": {"group": "ops", "since": 2020}}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	twice := filepath.Join(tmpDir, "twice.kdl")
+	if err := os.WriteFile(twice, []byte("@argnames \"a\"\n@argnames \"b\"\nnode 1 x=1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := convertFile(twice); err == nil || !strings.Contains(err.Error(), "already appears on line 1") {
+		t.Errorf("expected an error for a repeated directive, got %v", err)
+	}
+}
+
+func TestEmitDefaults(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	schemaJSON := `{
+		"type": "object",
+		"properties": {
+			"server": {
+				"type": "object",
+				"properties": {
+					"host": {"type": "string", "default": "localhost"},
+					"port": {"type": "integer", "default": 8080},
+					"tls": {"type": "object", "default": {"enabled": false}}
+				}
+			},
+			"route": {
+				"type": "array",
+				"items": {"properties": {"method": {"default": "GET"}}}
+			},
+			"debug": {"type": "boolean", "default": false},
+			"missing": {"type": "object", "properties": {"x": {"default": 1}}}
+		}
+	}`
+	if err := os.WriteFile(schemaPath, []byte(schemaJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := loadSchema(schemaPath)
+	if err != nil {
+		t.Fatalf("failed to load schema: %v", err)
+	}
+
+	result, err := convertSource(`server host="example.com" port=null
+route path="/a"
+route path="/b" method="POST"`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	applySchemaDefaults(result, schema)
+
+	jsonData, _ := json.Marshal(result)
+	expected := `{
+		"server": {"host": "example.com", "port": null, "tls": {"enabled": false}},
+		"route": [{"path": "/a", "method": "GET"}, {"path": "/b", "method": "POST"}],
+		"debug": false
+	}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E test: %v", err)
+	}
+
+	tmpDir := t.TempDir()
+	badSyntax := filepath.Join(tmpDir, "bad.kdl")
+	if err := os.WriteFile(badSyntax, []byte("node {\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	badInclude := filepath.Join(tmpDir, "include.kdl")
+	if err := os.WriteFile(badInclude, []byte("@include \"missing.kdl\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tooMany := filepath.Join(tmpDir, "props.kdl")
+	if err := os.WriteFile(tooMany, []byte("node a=1 b=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{"unknown flag", []string{"-no-such-flag", badSyntax}, exitUsage},
+		{"invalid flag value", []string{"-format", "xml", badSyntax}, exitUsage},
+		{"invalid -merge-arrays checked before converting", []string{"-merge-arrays", "zip", badSyntax}, exitUsage},
+		{"missing input file", []string{filepath.Join(tmpDir, "missing.kdl")}, exitInclude},
+		{"missing included file", []string{badInclude}, exitInclude},
+		{"parse error", []string{badSyntax}, exitParse},
+		{"conversion error", []string{"-max-properties", "1", tooMany}, exitConversion},
+		{"missing required key", []string{"-required", "other", tooMany}, exitConversion},
+	}
+	for _, tt := range tests {
+		_, stderr, err := runKDLcCapture(tt.args)
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Errorf("%s: expected kdlc to exit with status %d, got %v", tt.name, tt.expected, err)
+			continue
+		}
+		if code := exitErr.ExitCode(); code != tt.expected {
+			t.Errorf("%s: expected exit status %d, got %d (stderr: %s)", tt.name, tt.expected, code, stderr)
+		}
+	}
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+	if err := os.WriteFile(mainFile, []byte("top 1\n@include \"link.kdl\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(mainFile, filepath.Join(tmpDir, "link.kdl")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	sharedFile := filepath.Join(tmpDir, "shared.kdl")
+	if err := os.WriteFile(sharedFile, []byte("shared 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(sharedFile, filepath.Join(tmpDir, "alias.kdl")); err != nil {
+		t.Fatal(err)
+	}
+	twiceFile := filepath.Join(tmpDir, "twice.kdl")
+	if err := os.WriteFile(twiceFile, []byte("@include \"shared.kdl\"\n@include \"alias.kdl\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without resolving, the cycle is only noticed once link.kdl includes itself
+	_, err := processIncludes(mainFile, newIncludeState())
+	if err == nil || strings.Count(err.Error(), "failed to process include") != 2 {
+		t.Errorf("expected the cycle to be detected through link.kdl, got %v", err)
+	}
+
+	resolveSymlinks = true
+	dedupeIncludes = true
+	defer func() {
+		resolveSymlinks = false
+		dedupeIncludes = false
+	}()
+
+	// The link is main.kdl itself, so including it is a cycle straight away
+	_, err = processIncludes(mainFile, newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), "circular include detected") || strings.Count(err.Error(), "failed to process include") != 1 {
+		t.Errorf("expected the link to be detected as a cycle, got %v", err)
+	}
+
+	content, err := processIncludes(twiceFile, newIncludeState())
+	if err != nil {
+		t.Fatalf("failed to process includes: %v", err)
+	}
+	if count := strings.Count(content, "shared 1"); count != 1 {
+		t.Errorf("expected the aliased file to be included once, got %d copies in %q", count, content)
+	}
+}
+
+// decodeMsgpack decodes the MessagePack subset produced by encodeMsgpack, returning the value
+// and the bytes after it. Integers decode as int64 and maps as map[string]interface{}.
+func decodeMsgpack(t *testing.T, data []byte) (interface{}, []byte) {
+	t.Helper()
+	if len(data) == 0 {
+		t.Fatal("unexpected end of MessagePack data")
+	}
+	c, data := data[0], data[1:]
+	readUint := func(size int) uint64 {
+		var n uint64
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+		return n
+	}
+	str := func(n int) (interface{}, []byte) {
+		return string(data[:n]), data[n:]
+	}
+	array := func(n int) (interface{}, []byte) {
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], data = decodeMsgpack(t, data)
+		}
+		return items, data
+	}
+	object := func(n int) (interface{}, []byte) {
+		obj := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			var key, value interface{}
+			key, data = decodeMsgpack(t, data)
+			value, data = decodeMsgpack(t, data)
+			obj[key.(string)] = value
+		}
+		return obj, data
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), data
+	case c >= 0xe0:
+		return int64(int8(c)), data
+	case c&0xe0 == 0xa0:
+		return str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return array(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return object(int(c & 0x0f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, data
+	case 0xc2:
+		return false, data
+	case 0xc3:
+		return true, data
+	case 0xcb:
+		return math.Float64frombits(readUint(8)), data
+	case 0xcc:
+		return int64(readUint(1)), data
+	case 0xcd:
+		return int64(readUint(2)), data
+	case 0xce:
+		return int64(readUint(4)), data
+	case 0xcf:
+		return int64(readUint(8)), data
+	case 0xd0:
+		return int64(int8(readUint(1))), data
+	case 0xd1:
+		return int64(int16(readUint(2))), data
+	case 0xd2:
+		return int64(int32(readUint(4))), data
+	case 0xd3:
+		return int64(readUint(8)), data
+	case 0xd9:
+		return str(int(readUint(1)))
+	case 0xda:
+		return str(int(readUint(2)))
+	case 0xdb:
+		return str(int(readUint(4)))
+	case 0xdc:
+		return array(int(readUint(2)))
+	case 0xdd:
+		return array(int(readUint(4)))
+	case 0xde:
+		return object(int(readUint(2)))
+	case 0xdf:
+		return object(int(readUint(4)))
+	}
+	t.Fatalf("unexpected MessagePack type byte 0x%02x", c)
+	return nil, nil
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	result, err := convertSource(`server "web" port=8080 debug=true ratio=0.5 offset=-7 min=-40000 big=5000000000 note=null
+item "a"
+item "b"
+text "` + strings.Repeat("x", 40) + `"
+empty`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	data, err := encodeMsgpack(result)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	decoded, rest := decodeMsgpack(t, data)
+	if len(rest) != 0 {
+		t.Errorf("expected no trailing bytes, got %d", len(rest))
+	}
+
+	// Both encodings describe the same structure
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedJSON, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jsonEqualString(string(jsonData), string(decodedJSON)) {
+		t.Errorf("MessagePack decodes to %s, expected %s", decodedJSON, jsonData)
+	}
+
+	// Keys are sorted, so the encoding is stable
+	again, _ := encodeMsgpack(result)
+	if !bytes.Equal(data, again) {
+		t.Error("expected identical bytes for the same document")
+	}
+}
+
+func TestOnDuplicateProperty(t *testing.T) {
+	defer func() { onDuplicateProperty = "last-wins" }()
+
+	source := `server port=80 host="a" port=(u16)8080
+child { leaf x=1 x="two" x=3; }`
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{"last-wins", `{"server": {"port": 8080, "host": "a"}, "child": {"leaf": {"x": 3}}}`},
+		{"first-wins", `{"server": {"port": 80, "host": "a"}, "child": {"leaf": {"x": 1}}}`},
+		{"array", `{"server": {"port": [80, 8080], "host": "a"}, "child": {"leaf": {"x": [1, "two", 3]}}}`},
+	}
+	for _, tt := range tests {
+		onDuplicateProperty = tt.policy
+		result, err := convertSource(source)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.policy, err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", tt.policy, tt.expected, jsonData)
+		}
+	}
+
+	onDuplicateProperty = "error"
+	_, err := convertSource(source)
+	if err == nil || !strings.Contains(err.Error(), "property port is set 2 times") {
+		t.Errorf("error: expected a duplicate property error, got %v", err)
+	}
+	if _, err := convertSource(`server port=80 host="a"`); err != nil {
+		t.Errorf("error: expected no error without duplicates, got %v", err)
+	}
+}
+
+func TestFromPath(t *testing.T) {
+	source := `scene "Main" {
+    node "player" x=1 y=2 {
+        sprite "hero.png"
+    }
+    camera zoom=2.0
+}
+item "a" { size 1; }
+item "b" { size 2; }`
+
+	full, err := convertSource(source)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	defer func() { fromPath = "" }()
+
+	for _, path := range []string{"scene.node", "scene.camera", "item.1", "item.0.size"} {
+		fromPath = path
+		result, err := convertSource(source)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", path, err)
+		}
+		expected, ok := lookupPath(full, path)
+		if !ok {
+			t.Fatalf("%s: not in the full conversion", path)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("%s: expected %v, got %v", path, expected, result)
+		}
+	}
+
+	for path, message := range map[string]string{
+		"scene.missing": "no node at scene.missing",
+		"item":          "item matches 2 nodes; add an index such as item.0",
+		"item.2":        "no node at item.2",
+	} {
+		fromPath = path
+		if _, err := convertSource(source); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected error %q, got %v", path, message, err)
+		}
+	}
+}
+
+func TestNoGroup(t *testing.T) {
+	noGroup = true
+	defer func() { noGroup = false }()
+
+	result, err := convertSource(`item "a"
+other 1
+item "b" size=2
+config {
+    port 80
+    port 8080
+}
+item "c" size=3`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{"item": {"arg1": "c", "size": 3}, "other": 1, "config": {"port": 8080}}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	kdlConfig := filepath.Join(tmpDir, "kdlc.kdl")
+	if err := os.WriteFile(kdlConfig, []byte(`arg1 "name"
+arg2 "kind"
+quiet
+redact "*_token" "password"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jsonConfig := filepath.Join(tmpDir, "kdlc.json")
+	if err := os.WriteFile(jsonConfig, []byte(`{"arg1": "name", "arg2": "kind", "quiet": true, "redact": ["*_token", "password"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{kdlConfig, jsonConfig} {
+		fs := flag.NewFlagSet("kdlc", flag.ContinueOnError)
+		arg1 := fs.String("arg1", "arg1", "")
+		arg2 := fs.String("arg2", "arg2", "")
+		quietFlag := fs.Bool("quiet", false, "")
+		var redact stringList
+		fs.Var(&redact, "redact", "")
+		fs.StringVar(&configFile, "config", "", "")
+		if err := fs.Parse([]string{"-config", path, "-arg2", "override"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := applyConfig(fs); err != nil {
+			t.Fatalf("%s: failed to apply config: %v", path, err)
+		}
+		if *arg1 != "name" || *arg2 != "override" || !*quietFlag {
+			t.Errorf("%s: expected arg1=name arg2=override quiet=true, got arg1=%s arg2=%s quiet=%v", path, *arg1, *arg2, *quietFlag)
+		}
+		if strings.Join(redact, ",") != "*_token,password" {
+			t.Errorf("%s: expected both -redact values, got %v", path, redact)
+		}
+	}
+	configFile = ""
+
+	unknown := filepath.Join(tmpDir, "unknown.kdl")
+	if err := os.WriteFile(unknown, []byte("no-such-flag 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("kdlc", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", "", "")
+	if err := fs.Parse([]string{"-config", unknown}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs); err == nil || !strings.Contains(err.Error(), `unknown flag "no-such-flag"`) {
+		t.Errorf("expected an unknown flag error, got %v", err)
+	}
+	configFile = ""
+}
+
+func TestConfigFileE2E(t *testing.T) {
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E test: %v", err)
+	}
+	binary, err := filepath.Abs("./kdlc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config in the working directory is found without -config
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, ".kdlc.kdl"), []byte("arg1 \"name\"\narg2 \"kind\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "input.kdl"), []byte("item \"sword\" \"weapon\" damage=10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(binary, "-arg2", "category", "input.kdl")
+	cmd.Dir = tmpDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("kdlc failed: %v, output: %s", err, output)
+	}
+	expected := `{"item": {"name": "sword", "category": "weapon", "damage": 10}}`
+	if !jsonEqualString(expected, string(output)) {
+		t.Errorf("expected %s, got %s", expected, output)
+	}
+}
+
+func TestLineMap(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+	sceneFile := filepath.Join(tmpDir, "scene.kdl")
+	if err := os.WriteFile(mainFile, []byte("title \"Demo\"\n@include \"scene.kdl\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sceneFile, []byte(`scene {
+    node "player" x=100 y=200
+    tag "a" "b"
+    item 1
+    item 2
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, origins, err := includeSource(mainFile, newIncludeState())
+	if err != nil {
+		t.Fatalf("failed to process includes: %v", err)
+	}
+	locations, err := lineMap(data, origins)
+	if err != nil {
+		t.Fatalf("failed to build line map: %v", err)
+	}
+
+	scene := displayPath(sceneFile)
+	expected := map[string]sourceLocation{
+		"title":           {File: displayPath(mainFile), Line: 1, Column: 1},
+		"scene":           {File: scene, Line: 1, Column: 1},
+		"scene.node":      {File: scene, Line: 2, Column: 5},
+		"scene.node.arg1": {File: scene, Line: 2, Column: 10},
+		"scene.node.x":    {File: scene, Line: 2, Column: 19},
+		"scene.node.y":    {File: scene, Line: 2, Column: 25},
+		"scene.tag":       {File: scene, Line: 3, Column: 5},
+		"scene.tag.0":     {File: scene, Line: 3, Column: 9},
+		"scene.tag.1":     {File: scene, Line: 3, Column: 13},
+		"scene.item.0":    {File: scene, Line: 4, Column: 5},
+		"scene.item.1":    {File: scene, Line: 5, Column: 5},
+	}
+	if !reflect.DeepEqual(locations, expected) {
+		t.Errorf("expected %v, got %v", expected, locations)
+	}
+}
+
+func TestUnicodeEscapes(t *testing.T) {
+	keepTypesArgs = true
+	defer func() { keepTypesArgs = false }()
+
+	result, err := convertSource(`msg "smile \u{1F600} and caf\u{e9}" note="\u{263A}"
+tagged (t)"\u{1F600}"
+key "\u{1F600}"=1`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"msg":    map[string]interface{}{"arg1": "smile 😀 and café", "note": "☺"},
+		"tagged": map[string]interface{}{"type": "t", "value": "😀"},
+		"key":    map[string]interface{}{"😀": int64(1)},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+
+	// The runes are emitted as UTF-8, not as escape sequences
+	for _, encode := range []func(interface{}) ([]byte, error){marshalJSON, canonicalJSON} {
+		jsonData, err := encode(result)
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		if !bytes.Contains(jsonData, []byte("smile 😀 and café")) || bytes.Contains(jsonData, []byte(`\u`)) {
+			t.Errorf("expected literal UTF-8 characters, got %s", jsonData)
+		}
+	}
+}
+
+func TestKeyBy(t *testing.T) {
+	defer func() { keyByProps = make(map[string]string) }()
+	if err := applyKeyByMappings([]string{"item=name", "user=id"}); err != nil {
+		t.Fatalf("failed to apply mappings: %v", err)
+	}
+
+	result, err := convertSource(`item name="sword" damage=10
+item name="shield" defense=5
+user id=7 role="admin"
+other "x"`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{
+		"item": {
+			"sword": {"name": "sword", "damage": 10},
+			"shield": {"name": "shield", "defense": 5}
+		},
+		"user": {"7": {"id": 7, "role": "admin"}},
+		"other": "x"
+	}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	for source, message := range map[string]string{
+		"item name=\"a\"\nitem damage=1":   "node 1 has no name property to key by",
+		"item name=\"a\"\nitem name=\"a\"": `duplicate name "a"`,
+		"item \"a\"\nitem \"b\"":           "node 0 has no name property to key by",
+	} {
+		if _, err := convertSource(source); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected error %q, got %v", source, message, err)
+		}
+	}
+}
+
+func TestEmptyOK(t *testing.T) {
+	omitEmpty = true
+	defer func() {
+		omitEmpty = false
+		fromPath = ""
+		emptyOK = true
+	}()
+
+	// Everything is removed by -omit-empty, or the selected node has no value
+	empties := []struct {
+		name     string
+		path     string
+		expected interface{}
+	}{
+		{"omit-empty", "", map[string]interface{}{}},
+		{"from-path", "scene.marker", nil},
+	}
+	source := `scene { marker; extra null; }
+empty {}`
+	for _, tt := range empties {
+		fromPath = tt.path
+		result, err := convertSource(source)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.expected, result)
+		}
+
+		emptyOK = true
+		if err := checkEmptyResult(result); err != nil {
+			t.Errorf("%s: expected an empty result to be allowed, got %v", tt.name, err)
+		}
+		emptyOK = false
+		if err := checkEmptyResult(result); err == nil || !strings.Contains(err.Error(), "the result is empty") {
+			t.Errorf("%s: expected an empty result error, got %v", tt.name, err)
+		}
+	}
+
+	if err := checkEmptyResult(map[string]interface{}{"a": int64(1)}); err != nil {
+		t.Errorf("expected a non-empty result to pass, got %v", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	defer func() { transformProgram = nil }()
+
+	result, err := convertSource(`scene "Main" {
+    node "player" x=100 y=200
+    camera zoom=2
+}
+version 3`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`{"player": scene.node, "version": version}`, `{"player": {"arg1": "player", "x": 100, "y": 200}, "version": 3}`},
+		{`{"position": [doc.scene.node.x, doc.scene.node.y]}`, `{"position": [100, 200]}`},
+		{`sort(keys(scene))`, `["arg1", "camera", "node"]`},
+		{`scene.camera.zoom * 1.5`, `3`},
+	}
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: failed to compile: %v", tt.expr, err)
+		}
+		transformProgram = program
+		transformed, err := applyTransform(result)
+		if err != nil {
+			t.Fatalf("%s: failed to transform: %v", tt.expr, err)
+		}
+		jsonData, _ := json.Marshal(transformed)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", tt.expr, tt.expected, jsonData)
+		}
+	}
+
+	program, _ := expr.Compile(`scene.missing.x`)
+	transformProgram = program
+	if _, err := applyTransform(result); err == nil {
+		t.Error("expected an error for a field of a missing value")
+	}
+}
+
+func TestRemoteIncludeChecksum(t *testing.T) {
+	fragment := "remote \"${name}\" port=8080\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, fragment)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256([]byte(fragment))
+	checksum := hex.EncodeToString(sum[:])
+
+	tmpDir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	matching := write("match.kdl", fmt.Sprintf("@include \"%s/frag.kdl\" sha256=\"%s\" name=\"api\"\n", server.URL, strings.ToUpper(checksum)))
+	mismatched := write("mismatch.kdl", fmt.Sprintf("@include \"%s/frag.kdl\" sha256=\"%064d\"\n", server.URL, 0))
+
+	// Remote includes are opt-in
+	if _, err := processIncludes(matching, newIncludeState()); err == nil || !strings.Contains(err.Error(), "-allow-remote-includes") {
+		t.Errorf("expected remote includes to be disabled by default, got %v", err)
+	}
+
+	allowRemoteIncludes = true
+	defer func() { allowRemoteIncludes = false }()
+
+	content, origins, err := includeSource(matching, newIncludeState())
+	if err != nil {
+		t.Fatalf("failed to process includes: %v", err)
+	}
+	if !strings.Contains(content, `remote "api" port=8080`) || strings.Contains(content, checksum) {
+		t.Errorf("expected the verified fragment with parameters substituted, got %q", content)
+	}
+	if origins[0].File != server.URL+"/frag.kdl" || origins[0].Line != 1 {
+		t.Errorf("expected lines to come from the URL, got %v", origins[0])
+	}
+
+	_, err = processIncludes(mismatched, newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") || !strings.Contains(err.Error(), checksum) {
+		t.Errorf("expected a checksum mismatch error, got %v", err)
+	}
+
+	// A directive skipped by -dedupe-includes is still held to its pin
+	dedupeIncludes = true
+	defer func() { dedupeIncludes = false }()
+	conflicting := write("conflict.kdl", fmt.Sprintf("@include \"%s/frag.kdl\" sha256=\"%s\" name=\"a\"\n@include \"%s/frag.kdl\" sha256=\"%064d\" name=\"b\"\n", server.URL, checksum, server.URL, 0))
+	_, err = processIncludes(conflicting, newIncludeState())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch error for the deduplicated include, got %v", err)
+	}
+	repeated := write("repeat.kdl", fmt.Sprintf("@include \"%s/frag.kdl\" sha256=\"%s\" name=\"a\"\n@include \"%s/frag.kdl\" sha256=\"%s\" name=\"b\"\n", server.URL, checksum, server.URL, checksum))
+	if _, err := processIncludes(repeated, newIncludeState()); err != nil {
+		t.Errorf("expected matching pins to pass, got %v", err)
+	}
+}
+
+func TestNodeFilter(t *testing.T) {
+	defer func() { nodeFilterProgram = nil }()
+
+	input := `route "/users" method="GET"
+route "/users" method="POST"
+route "/health" method="GET"
+server {
+    listen 8080
+    debug true
+}`
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`name == "route" && props.method == "GET"`, `{"route": [{"arg1": "/users", "method": "GET"}, {"arg1": "/health", "method": "GET"}]}`},
+		{`depth > 0 || name == "server"`, `{"server": {"listen": 8080, "debug": true}}`},
+		{`name != "debug" && (children > 0 || props.method != "POST")`, `{"route": [{"arg1": "/users", "method": "GET"}, {"arg1": "/health", "method": "GET"}], "server": {"listen": 8080}}`},
+		{`len(args) > 0 && args[0] == "/health"`, `{"route": {"arg1": "/health", "method": "GET"}}`},
+	}
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.expr, expr.AsBool())
+		if err != nil {
+			t.Fatalf("%s: failed to compile: %v", tt.expr, err)
+		}
+		nodeFilterProgram = program
+		result, err := convertSource(input)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.expr, err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", tt.expr, tt.expected, jsonData)
+		}
+	}
+}
+
+func TestArgsAsObject(t *testing.T) {
+	kdlContent := `point 1 2 3
+label "origin"
+pair "a" "b" note="x"`
+
+	tests := []struct {
+		argsAsObject bool
+		expected     string
+	}{
+		{false, `{"point": [1, 2, 3], "label": "origin", "pair": {"arg1": "a", "arg2": "b", "note": "x"}}`},
+		{true, `{"point": {"arg1": 1, "arg2": 2, "arg3": 3}, "label": "origin", "pair": {"arg1": "a", "arg2": "b", "note": "x"}}`},
+	}
+
+	defer func() { argsAsObject = false }()
+	for _, tt := range tests {
+		argsAsObject = tt.argsAsObject
+		result, err := convertSource(kdlContent)
+		if err != nil {
+			t.Fatalf("failed to convert: %v", err)
+		}
+		jsonData, _ := json.Marshal(result)
+		if !jsonEqualString(tt.expected, string(jsonData)) {
+			t.Errorf("-args-as-object=%v: expected %s, got %s", tt.argsAsObject, tt.expected, jsonData)
+		}
+	}
+}
+
+func TestPreserveIncludeBoundaries(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"main.kdl":  "name \"app\"\n@include \"db.kdl\"\n@include \"cache.kdl\"\n",
+		"db.kdl":    "server \"db1\"\nserver \"db2\"\n",
+		"cache.kdl": "server \"redis\" port=6379\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mainFile := filepath.Join(tmpDir, "main.kdl")
+
+	// Merged, the servers of both files form one array
+	result, err := convertFile(mainFile)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	if expected := `{"name": "app", "server": ["db1", "db2", {"arg1": "redis", "port": 6379}]}`; !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	preserveIncludeBoundaries = true
+	defer func() { preserveIncludeBoundaries = false }()
+
+	result, err = convertFile(mainFile)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	sections, ok := result.(map[string]interface{})
+	if !ok || len(sections) != 3 {
+		t.Fatalf("expected a section for each of the 3 files, got %v", result)
+	}
+	expected := map[string]string{
+		"main.kdl":  `{"name": "app"}`,
+		"db.kdl":    `{"server": ["db1", "db2"]}`,
+		"cache.kdl": `{"server": {"arg1": "redis", "port": 6379}}`,
+	}
+	for name, want := range expected {
+		section, ok := sections[displayPath(filepath.Join(tmpDir, name))]
+		if !ok {
+			t.Errorf("missing section for %s in %v", name, sections)
+			continue
+		}
+		jsonData, _ := json.Marshal(section)
+		if !jsonEqualString(want, string(jsonData)) {
+			t.Errorf("%s: expected %s, got %s", name, want, jsonData)
+		}
+	}
+
+	// Boundaries that can't be attributed fail rather than falling back to merged output
+	_, err = convertIncludeSource("a 1\nb 2", []lineOrigin{{File: mainFile, Line: 1}})
+	if err == nil || !strings.Contains(err.Error(), "cannot tell which file the node at line 2 came from") {
+		t.Errorf("expected an attribution error, got %v", err)
+	}
+}
+
+func TestNullInput(t *testing.T) {
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E test: %v", err)
+	}
+	t.Setenv("KDLC_TEST_SERVICE", "billing")
+
+	stdout, stderr, err := runKDLcCapture([]string{"-null-input", "-var", "replicas=3",
+		"-transform", `{"service": env.KDLC_TEST_SERVICE, "replicas": int(replicas), "ports": [80, 443]}`})
+	if err != nil {
+		t.Fatalf("kdlc failed: %v\n%s", err, stderr)
+	}
+	if expected := `{"service": "billing", "replicas": 3, "ports": [80, 443]}`; !jsonEqualString(expected, stdout) {
+		t.Errorf("expected %s, got %s", expected, stdout)
+	}
+
+	// Without a transform there is nothing to produce
+	_, stderr, err = runKDLcCapture([]string{"-null-input"})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage || !strings.Contains(stderr, "-null-input requires -transform") {
+		t.Errorf("expected a usage error, got %v: %s", err, stderr)
+	}
+}
+
+func TestEncodeGo(t *testing.T) {
+	result, err := convertSource(`server "web" port=8080 ratio=1.0 debug=false
+list 1 2.5 -3
+empty
+nested {
+    deep text="tab\tquote\""
+}`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+
+	source, err := encodeGo(result, "settings", "Defaults")
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if formatted, err := format.Source(source); err != nil || !bytes.Equal(formatted, source) {
+		t.Errorf("expected gofmt-formatted source, got %q (%v)", source, err)
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), "config.go", source, 0)
+	if err != nil {
+		t.Fatalf("generated Go doesn't parse: %v\n%s", err, source)
+	}
+	if file.Name.Name != "settings" || len(file.Decls) != 1 {
+		t.Fatalf("expected one declaration in package settings, got %s", source)
+	}
+	spec := file.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec)
+	if spec.Names[0].Name != "Defaults" {
+		t.Errorf("expected the variable Defaults, got %s", spec.Names[0].Name)
+	}
+
+	// Evaluate the literal back into a value and compare it with the converted document
+	var eval func(expr ast.Expr) interface{}
+	eval = func(expr ast.Expr) interface{} {
+		switch e := expr.(type) {
+		case *ast.CompositeLit:
+			if _, ok := e.Type.(*ast.MapType); ok {
+				obj := make(map[string]interface{})
+				for _, elt := range e.Elts {
+					kv := elt.(*ast.KeyValueExpr)
+					obj[eval(kv.Key).(string)] = eval(kv.Value)
+				}
+				return obj
+			}
+			array := make([]interface{}, len(e.Elts))
+			for i, elt := range e.Elts {
+				array[i] = eval(elt)
+			}
+			return array
+		case *ast.BasicLit:
+			switch e.Kind {
+			case token.STRING:
+				s, _ := strconv.Unquote(e.Value)
+				return s
+			case token.INT:
+				n, _ := strconv.ParseInt(e.Value, 10, 64)
+				return n
+			default:
+				f, _ := strconv.ParseFloat(e.Value, 64)
+				return f
+			}
+		case *ast.UnaryExpr:
+			switch v := eval(e.X).(type) {
+			case int64:
+				return -v
+			case float64:
+				return -v
+			}
+		case *ast.Ident:
+			switch e.Name {
+			case "true":
+				return true
+			case "false":
+				return false
+			case "nil":
+				return nil
+			}
+		}
+		t.Fatalf("unexpected expression %T in %s", expr, source)
+		return nil
+	}
+	if decoded := eval(spec.Values[0]); !reflect.DeepEqual(decoded, result) {
+		t.Errorf("expected %#v, got %#v", result, decoded)
+	}
+
+	// The written file must pass a gofmt check as well
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E check: %v", err)
+	}
+	tmpDir := t.TempDir()
+	input := filepath.Join(tmpDir, "config.kdl")
+	output := filepath.Join(tmpDir, "config.go")
+	if err := os.WriteFile(input, []byte("server port=8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, err := runKDLcCapture([]string{"-format", "go", "-output", output, input}); err != nil {
+		t.Fatalf("kdlc failed: %v\n%s", err, stderr)
+	}
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted, err := format.Source(written); err != nil || !bytes.Equal(formatted, written) {
+		t.Errorf("expected the written file to be gofmt-formatted, got %q (%v)", written, err)
+	}
+}
+
+func TestValidateIncludesOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// Neither file is valid KDL, which only a parse would notice
+	write("part.kdl", "broken {\n")
+	good := write("good.kdl", "@include-only \"part.kdl\" \"broken\"\nnode {\n")
+	missing := write("missing.kdl", "node {\n@include \"part.kdl\"\n@include \"absent.kdl\"\n")
+
+	validateIncludesOnly = true
+	defer func() { validateIncludesOnly = false }()
+
+	if err := validateIncludes([]string{good}); err != nil {
+		t.Errorf("expected the include graph to resolve, got %v", err)
+	}
+	err := validateIncludes([]string{good, missing})
+	if err == nil || !strings.Contains(err.Error(), "absent.kdl") {
+		t.Errorf("expected the missing include to be reported, got %v", err)
+	}
+
+	// Validation must not leave unselected nodes in the include cache for later conversions
+	write("frag.kdl", "a 1\nb 2\n")
+	selective := write("selective.kdl", "@include-only \"frag.kdl\" \"a\"\nc 3\n")
+	cacheDir = filepath.Join(tmpDir, "cache")
+	defer func() { cacheDir = "" }()
+	if err := validateIncludes([]string{selective}); err != nil {
+		t.Fatalf("expected the include graph to resolve, got %v", err)
+	}
+	validateIncludesOnly = false
+	result, err := convertFile(selective)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	if expected := `{"a": 1, "c": 3}`; !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s after validating with a cache, got %s", expected, jsonData)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	kdlContent := `(px)width 200
+(ms)timeout 500
+margin (px)1.5
+box w=(px)10 label=(px)"wide" depth=(cm)3`
+
+	result, err := convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	if expected := `{"width": 200, "timeout": 500, "margin": 1.5, "box": {"w": 10, "label": "(px)wide", "depth": 3}}`; !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("without -units: expected %s, got %s", expected, jsonData)
+	}
+
+	unitTypes = map[string]bool{"px": true, "ms": true}
+	defer func() { unitTypes = make(map[string]bool) }()
+
+	result, err = convertSource(kdlContent)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ = json.Marshal(result)
+	expected := `{
+  "width": {"value": 200, "unit": "px"},
+  "timeout": {"value": 500, "unit": "ms"},
+  "margin": {"value": 1.5, "unit": "px"},
+  "box": {"w": {"value": 10, "unit": "px"}, "label": "(px)wide", "depth": 3}
+}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("with -units: expected %s, got %s", expected, jsonData)
+	}
+}
+
+func TestCollapseProperties(t *testing.T) {
+	collapseProperties = true
+	defer func() {
+		collapseProperties = false
+		collapseDelimiter = "."
+	}()
+
+	result, err := convertSource(`window "main" {
+    size width=800 height=600
+    position { offset x=10 y=20; }
+}
+theme dark=true`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ := json.Marshal(result)
+	expected := `{
+  "window": {"arg1": "main", "size.width": 800, "size.height": 600, "position.offset.x": 10, "position.offset.y": 20},
+  "theme.dark": true
+}`
+	if !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+
+	collapseDelimiter = "_"
+	result, err = convertSource(`window { size width=800; }`)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	jsonData, _ = json.Marshal(result)
+	if expected := `{"window_size_width": 800}`; !jsonEqualString(expected, string(jsonData)) {
+		t.Errorf("expected %s, got %s", expected, jsonData)
+	}
+	collapseDelimiter = "."
+
+	for _, input := range []string{
+		"window {\n    size width=800\n    size width=600\n}",
+		"window size.width=1 {\n    size width=800\n}",
+		"window \"main\" size.width=1 {\n    size width=800\n}",
+		"size width=1\n\"size.width\" 2",
+	} {
+		_, err := convertSource(input)
+		if err == nil || !strings.Contains(err.Error(), `"size.width"`) {
+			t.Errorf("%q: expected a collision error, got %v", input, err)
+		}
+	}
+
+	// The error names both sides of a collision with a node
+	_, err = convertSource("size width=1\n\"size.width\" 2")
+	if err == nil || !strings.Contains(err.Error(), `property "width" hoisted from collapsed node "size" collides with an existing child node named "size.width"`) {
+		t.Errorf("expected the collapsed node and property in the error, got %v", err)
+	}
+}
+
+func TestStreamRejectsWholeDocumentShapes(t *testing.T) {
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E test: %v", err)
+	}
+
+	input := filepath.Join(t.TempDir(), "items.kdl")
+	if err := os.WriteFile(input, []byte("item 1\nitem 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range [][]string{
+		{"-root-array"}, {"-unwrap"}, {"-transform", "item"}, {"-rename", "item=thing"},
+		{"-strip-prefix", "it"}, {"-required", "item"}, {"-canonicalize"}, {"-envelope"},
+		{"-hash"}, {"-leaves"}, {"-split-dir", t.TempDir()}, {"-merge-into", input},
+	} {
+		stdout, stderr, err := runKDLcCapture(append(append([]string{"-stream"}, option...), input))
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage || !strings.Contains(stderr, "-stream cannot be used with") {
+			t.Errorf("-stream %s: expected a usage error, got %v: %s", option, err, stderr)
+		}
+		if stdout != "" {
+			t.Errorf("-stream %s: expected no output, got %s", option, stdout)
+		}
+	}
+}
+
+func TestValidateIncludesOnlyInputGlob(t *testing.T) {
+	if err := checkBinaryExists(); err != nil {
+		t.Skipf("Skipping E2E test: %v", err)
+	}
+
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "a.kdl"), []byte("a 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "b.kdl"), []byte("@include \"absent.kdl\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every matching file is checked, not just positional arguments
+	_, stderr, err := runKDLcCapture([]string{"-validate-includes-only", "-input-glob", filepath.Join(tmpDir, "*.kdl")})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitInclude || !strings.Contains(stderr, "absent.kdl") {
+		t.Errorf("expected the missing include of b.kdl to be reported, got %v: %s", err, stderr)
+	}
+
+	_, stderr, err = runKDLcCapture([]string{"-validate-includes-only", "-input-glob", filepath.Join(tmpDir, "a*.kdl")})
+	if err != nil {
+		t.Errorf("expected a.kdl to validate, got %v: %s", err, stderr)
+	}
+}
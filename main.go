@@ -1,18 +1,46 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
 	"github.com/sblinch/kdl-go"
 	"github.com/sblinch/kdl-go/document"
 )
 
+// Version of kdlc, set with -ldflags at release time
+var version = "dev"
+
 // Global configuration for argument name mapping
 var argNameMap = map[int]string{
 	1: "arg1",
@@ -22,6 +50,412 @@ var argNameMap = map[int]string{
 	5: "arg5",
 }
 
+// Skip files that have already been included once
+var dedupeIncludes bool
+
+// Colorize output: "auto", "always", or "never"
+var colorMode = "auto"
+
+// Directory to write one JSON file per top-level node into
+var splitDir string
+
+// Emit RFC 8785 canonical JSON
+var canonicalize bool
+
+// Drop nulls, empty objects and (unless keepEmptyArrays) empty arrays from the output
+var omitEmpty bool
+var keepEmptyArrays bool
+
+// Print the transitive include set instead of converting
+var listIncludesOnly bool
+
+// Check that the include graph resolves without parsing or converting anything
+var validateIncludesOnly bool
+
+// Emit null instead of failing on NaN and infinite numbers
+var allowNonFinite bool
+
+// Prefix for synthetic metadata keys added by kdlc
+var metaPrefix = "_"
+
+// What to do when a document key equals a metadata key being added: warn (the metadata
+// replaces it), error, or escape (the document key gets another metadata prefix)
+var metaCollision = "warn"
+
+// Destination for warnings
+var warnOutput io.Writer = os.Stderr
+
+// Real keys already reported as using the metadata prefix
+var (
+	warnedMetaKeys   = make(map[string]bool)
+	warnedMetaKeysMu sync.Mutex
+)
+
+// Resolvers for type-annotated values, keyed by type annotation
+var typeResolvers = make(map[string]typeResolver)
+
+// TYPE=RESOLVER mappings from -resolver
+var resolverMappings stringList
+
+// Maximum number of distinct files include processing may open (0 means unlimited)
+var maxFiles int
+
+// Nest the nodes of each included file under a key naming the file instead of merging them
+var preserveIncludeBoundaries bool
+
+// Fetch @include targets given as http:// or https:// URLs
+var allowRemoteIncludes bool
+
+// remoteIncludeTimeout limits how long fetching one remote include may take
+const remoteIncludeTimeout = 30 * time.Second
+
+// Comma-separated type annotations that name units, from -units
+var unitNames string
+
+// Type annotations emitted as {"value": ..., "unit": ...} on numbers, e.g. px and ms
+var unitTypes = make(map[string]bool)
+
+// Emit type-annotated arguments and properties as {"type": ..., "value": ...} objects
+var keepTypesArgs bool
+var keepTypesProps bool
+
+// File listing KDL inputs to merge, used instead of the positional argument
+var manifestFile string
+
+// In multi-file mode, keep converting after a file fails
+var continueOnError bool
+
+// Emit a bare JSON array when every top-level node shares one name
+var rootArray bool
+
+// Suppress warnings and other informational stderr output
+var quiet bool
+
+// Name a node's arguments from the words of its trailing comment
+var commentArgNames bool
+
+// Write <, > and & literally instead of as \u003c, \u003e and \u0026
+var noEscapeHTML bool
+
+// Existing JSON file to merge the converted document into
+var mergeInto string
+
+// How arrays present in both the existing JSON and the document are merged: replace or append
+var mergeArrays = "replace"
+
+// Emit a JSON Schema inferred from the converted document instead of the document itself
+var inferSchemaOnly bool
+
+// How node arguments are emitted: auto (bare values unless the node is an object) or named (always argN keys)
+var argMode = "auto"
+
+// Emit argument-only nodes with several arguments as objects with named keys instead of arrays
+var argsAsObject bool
+
+// Number of significant digits for floating-point values (0 = shortest exact representation)
+var floatPrecision int
+
+// Archive (.zip, .tar.gz or .tgz) to write the per-node files to instead of a directory
+var splitArchive string
+
+// Dotted paths that must be present in the converted document
+var requiredPaths stringList
+
+// JSON types that arguments are coerced to, keyed by 1-based argument index
+var argTypes = make(map[int]string)
+
+// Coercions from the command line, as "INDEX=TYPE"
+var argTypeMappings stringList
+
+// File to write the JSON output to instead of stdout
+var outputFile string
+
+// Directory that relative output paths are resolved against instead of the working directory
+var relativeTo string
+
+// Patterns file (gitignore syntax subset) of files skipped when expanding directory and glob includes
+var includeIgnoreFile string
+
+// Rules loaded from includeIgnoreFile
+var includeIgnoreRules []ignoreRule
+
+// Accept input files that are not valid UTF-8
+var allowInvalidUTF8 bool
+
+// Emit each top-level node as its own line of JSON without building the whole document
+var streamOutput bool
+
+// Remove structurally equal duplicates from arrays of grouped nodes
+var dedupArrays bool
+
+// Record the file each top-level node came from under a metadata key
+var withSource bool
+
+// Output key renames as FROM=TO, where FROM is a dotted path
+var renameMappings stringList
+
+// keyRename renames the key at dotted path from to the key name to
+type keyRename struct {
+	from string
+	to   string
+}
+
+// Parsed -rename mappings, applied in order
+var renames []keyRename
+
+// Warn about lines of input files longer than this many characters (0 = no limit)
+var maxLineLength int
+
+// Warn about input lines whose indentation mixes tabs and spaces
+var lintIndentation bool
+
+// Emit each node's children as an ordered list of {"name", "value"} objects
+var childrenAsList bool
+
+// Prefix removed from output keys that start with it
+var stripPrefix string
+
+// JSON Schema file describing the output
+var schemaFile string
+
+// Fill in the schema's default values for properties the document omits
+var emitDefaults bool
+
+// Schema loaded from -schema
+var outputSchema map[string]interface{}
+
+// Identify included files by their symlink-resolved path, so aliases count as one file
+var resolveSymlinks bool
+
+// Write binary -format output even when stdout is a terminal
+var forceBinary bool
+
+// What to do with a property set more than once on a node: last-wins, first-wins, array or error
+var onDuplicateProperty = "last-wins"
+
+// Dotted path of the node to convert instead of the whole document
+var fromPath string
+
+// Let a later node overwrite an earlier one with the same name instead of grouping them
+var noGroup bool
+
+// Config file of default flag values; .kdlc.kdl or .kdlc.json in the working directory if unset
+var configFile string
+
+// Also write a JSON map from each output path to its source location to this file
+var lineMapFile string
+
+// Nodes to convert to an object keyed by one of their properties, as NODE=PROP
+var keyByMappings stringList
+
+// Parsed -key-by mappings from node name to key property
+var keyByProps = make(map[string]string)
+
+// Treat a result with nothing in it as success; when false it is an error
+var emptyOK = true
+
+// Expression computing the output from the converted document
+var transformExpr string
+
+// Compiled -transform expression
+var transformProgram *vm.Program
+
+// Run without an input file, producing the output from -transform alone
+var nullInput bool
+
+// NAME=VALUE string variables for -transform from -var
+var transformVarMappings stringList
+
+// Variables bound in -transform expressions, parsed from -var
+var transformVars = make(map[string]interface{})
+
+// Predicate deciding which nodes are converted
+var nodeFilterExpr string
+
+// Compiled -node-filter predicate
+var nodeFilterProgram *vm.Program
+
+// Node name aliases as FROM=TO, applied before nodes are grouped
+var aliasMappings stringList
+
+// Parsed -alias mappings from node name to canonical name
+var nodeAliases = make(map[string]string)
+
+// Maximum size in bytes of the generated output (0 = unlimited)
+var maxOutputSize int64
+
+// Name of the top-level node lifted out of the body into the _schema metadata key
+var schemaNodeName string
+
+// Key names (or glob patterns) whose values are masked in the output
+var redactKeys stringList
+
+// Emit hex, octal and binary numbers, and numbers written with underscores, as strings of
+// their source text
+var preserveNumberFormat bool
+
+// Allowed argument counts per node name, as NAME=MIN..MAX
+var argCountMappings stringList
+
+// argCountRange is an inclusive range of argument counts; max is -1 when unbounded
+type argCountRange struct {
+	min int
+	max int
+}
+
+// Parsed -args constraints by node name
+var argCounts = make(map[string]argCountRange)
+
+// Output format: json, msgpack, go, or dot for a Graphviz graph of the node structure
+var outputFormat = "json"
+
+// Variable and package names of the generated Go source with -format go
+var (
+	goVarName     = "Config"
+	goPackageName = "config"
+)
+
+// Name the sole argument of a node with properties or children -flatten-args-key
+var flattenArgs bool
+
+// Key for the sole argument with -flatten-args
+var flattenArgsKey = "value"
+
+// File to write a Makefile dependency rule for the output to
+var depFile string
+
+// File to write node documentation, gathered from comments, to
+var docsFile string
+
+// Convert every file matching this pattern to its own JSON file in -split-dir
+var inputGlob string
+
+// Convert children named "0", "1", ... "n-1" to an array instead of an object
+var numericArrays bool
+
+// Print a SHA-256 hash of the canonical form of the converted document to stderr
+var hashOutput bool
+
+// Number of files -input-glob converts concurrently
+var parallelJobs = 1
+
+// Emit nodes with arguments as {"args": [...], "props": {...}} so their shape doesn't change
+// when a property is added
+var stableShape bool
+
+// Node and property names (or glob patterns) whose values are emitted as strings
+var stringifyKeys stringList
+
+// Emit one {"path", "value"} line per leaf value instead of the JSON document
+var leavesOutput bool
+
+// Emit the value of the single top-level node instead of the {"name": value} document
+var unwrap bool
+
+// With -unwrap, record the unwrapped node's name and type annotation as metadata keys
+var emitRootType bool
+
+// Replace a node that has only a single child with that child's value
+var collapseSingleChild bool
+
+// Hoist the properties of argument-free nodes into their parent under prefixed keys
+var collapseProperties bool
+
+// Separator between the node name and property name of keys hoisted by -collapse-properties
+var collapseDelimiter = "."
+
+// Directory for caching include-expanded files across invocations
+var cacheDir string
+
+// Convert the strings "true" and "false" to booleans
+var normalizeBools bool
+
+// With -normalize-bools, also convert "yes" and "no"
+var normalizeYesNo bool
+
+// Maximum number of properties on a single node (0 = unlimited)
+var maxProperties int
+
+// repeatDirective includes a file a given number of times, e.g. @repeat 3 "card.kdl"
+const repeatDirective = "@repeat"
+
+// maxRepeatCount caps an @repeat count, even without -max-files, so a typo can't exhaust memory
+const maxRepeatCount = 10000
+
+// argNamesDirective names the arguments of the nodes in the file it appears in,
+// e.g. @argnames "host" "port"
+const argNamesDirective = "@argnames"
+
+// Matches an @argnames directive line, capturing the quoted names
+var argNamesRegex = regexp.MustCompile(`^\s*` + argNamesDirective + `((?:\s+"[^"]+")*)\s*$`)
+
+// Token that starts an include directive
+var includeDirective = "@include"
+
+// Don't end the output with a newline
+var noTrailingNewline bool
+
+// Collect node type annotations into a separate tree under the "types" metadata key
+var typesSidecar bool
+
+// Wrap the output in {"meta": {...}, "data": ...}
+var envelope bool
+
+// Comma-separated metadata fields included in the envelope
+var envelopeFields = "source,generated_at,kdlc_version"
+
+// Group nodes by lowercased name, emitting lowercase keys
+var caseInsensitiveNames bool
+
+// Dotted output path whose source location is reported on stderr
+var explainPathFlag string
+
+// Name for a node's last argument, regardless of its position
+var argLastName string
+
+// Warn about node names that are singular in one file but grouped into an array after includes
+var warnShapeInstability bool
+
+// Emit scalars as {"value": ..., "raw": ...} with their original KDL text
+var withRaw bool
+
+// Fail on values whose Go type convertValue doesn't handle instead of stringifying them
+var failOnUnknownType bool
+
+// Exit statuses distinguishing the kinds of failure
+const (
+	exitFailure    = 1 // any other failure, such as an unreadable schema or unwritable output
+	exitUsage      = 2 // invalid flags or arguments
+	exitInclude    = 3 // the input or an included file could not be read or resolved
+	exitParse      = 4 // the input is not valid KDL
+	exitConversion = 5 // valid KDL that can't be converted, or output failing a check like -required
+)
+
+// defaultsNodeName is the name of the block providing fallback values for the document
+const defaultsNodeName = "@defaults"
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// typeResolver converts a type-annotated KDL value into its JSON representation
+type typeResolver func(value *document.Value) (interface{}, error)
+
+// builtinResolvers are the resolvers available to -resolver
+var builtinResolvers = map[string]typeResolver{
+	"duration":  resolveDuration,
+	"date-time": resolveDateTime,
+	"date":      resolveDate,
+}
+
 // getArgName returns the configured name for the given argument index
 func getArgName(index int) string {
 	if name, exists := argNameMap[index]; exists {
@@ -30,6 +464,76 @@ func getArgName(index int) string {
 	return fmt.Sprintf("arg%d", index)
 }
 
+// nodeArgName returns the name for the given argument index of node, preferring names
+// declared in the node's trailing comment when -comment-arg-names is set, then the
+// -flatten-args key for a sole argument, then the -arg-last name for the final argument
+func nodeArgName(infos nodeInfos, node *document.Node, index int) string {
+	if commentArgNames {
+		if info := infos[node]; info != nil {
+			if names := strings.Fields(info.comment); index <= len(names) {
+				return names[index-1]
+			}
+		}
+	}
+	if flattenArgs && len(node.Arguments) == 1 {
+		return flattenArgsKey
+	}
+	if argLastName != "" && index == len(node.Arguments) {
+		return argLastName
+	}
+	if info := infos[node]; info != nil && index <= len(info.argNames) {
+		return info.argNames[index-1]
+	}
+	return getArgName(index)
+}
+
+// metaKey returns the output key for the synthetic metadata field name
+func metaKey(name string) string {
+	return metaPrefix + name
+}
+
+// checkMetaPrefix warns (once per key) when a real node or property name uses the metadata prefix
+func checkMetaPrefix(key string) {
+	if metaPrefix == "" || !strings.HasPrefix(key, metaPrefix) {
+		return
+	}
+	warnedMetaKeysMu.Lock()
+	defer warnedMetaKeysMu.Unlock()
+	if warnedMetaKeys[key] {
+		return
+	}
+	warnedMetaKeys[key] = true
+	warnf("key %q uses the metadata prefix %q and may collide with keys added by kdlc", key, metaPrefix)
+}
+
+// setMetaKey adds the metadata key for name to obj, resolving a collision with a key from the
+// document according to -meta-collision
+func setMetaKey(obj map[string]interface{}, name string, value interface{}) error {
+	key := metaKey(name)
+	if existing, ok := obj[key]; ok {
+		switch metaCollision {
+		case "error":
+			return fmt.Errorf("key %q collides with the metadata key kdlc adds (see -meta-collision)", key)
+		case "escape":
+			escaped := metaPrefix + key
+			for {
+				if _, taken := obj[escaped]; !taken {
+					break
+				}
+				escaped = metaPrefix + escaped
+			}
+			obj[escaped] = existing
+		}
+	}
+	obj[key] = value
+	return nil
+}
+
+// warnf writes a warning message
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(warnOutput, "Warning: "+format+"\n", args...)
+}
+
 func main() {
 	// Define command line flags
 	arg1Name := flag.String("arg1", "arg1", "Name for the first argument")
@@ -37,9 +541,131 @@ func main() {
 	arg3Name := flag.String("arg3", "arg3", "Name for the third argument")
 	arg4Name := flag.String("arg4", "arg4", "Name for the fourth argument")
 	arg5Name := flag.String("arg5", "arg5", "Name for the fifth argument")
+	flag.StringVar(&colorMode, "color", "auto", "Colorize JSON output: auto, always, or never")
+	flag.StringVar(&splitDir, "split-dir", "", "Write each top-level node to `DIR`/<name>.json instead of stdout")
+	flag.BoolVar(&canonicalize, "canonicalize", false, "Emit canonical JSON (RFC 8785 JCS) suitable for hashing and signing")
+	flag.BoolVar(&omitEmpty, "omit-empty", false, "Omit null values, empty objects and empty arrays from the output")
+	flag.BoolVar(&keepEmptyArrays, "keep-empty-arrays", false, "With -omit-empty, keep empty arrays")
+	flag.StringVar(&metaPrefix, "meta-prefix", "_", "Prefix for metadata keys added by kdlc")
+	flag.BoolVar(&allowNonFinite, "allow-nonfinite", false, "Emit null for NaN and infinite numbers instead of failing")
+	flag.BoolVar(&listIncludesOnly, "list-includes", false, "Print the sorted absolute paths of all files the input includes (transitively) and exit")
+	flag.BoolVar(&validateIncludesOnly, "validate-includes-only", false, "Check that every include target exists and there are no include cycles, without parsing, and exit")
+	flag.BoolVar(&dedupeIncludes, "dedupe-includes", false, "Include each file at most once, skipping repeated @include directives")
+	flag.Var(&resolverMappings, "resolver", "Resolve values annotated with `TYPE=RESOLVER` using a built-in resolver (duration, date-time, date); repeatable")
+	flag.IntVar(&maxFiles, "max-files", 0, "Fail if include processing would open more than `N` distinct files (0 = unlimited)")
+	flag.BoolVar(&preserveIncludeBoundaries, "preserve-include-boundaries", false, "Emit the nodes of each file under a key naming the file instead of merging included files")
+	flag.BoolVar(&allowRemoteIncludes, "allow-remote-includes", false, "Allow @include to fetch http:// and https:// URLs")
+	flag.StringVar(&unitNames, "units", "", "Comma-separated type annotations, such as `px,ms`, that mark numbers as quantities emitted as {\"value\", \"unit\"} objects")
+	keepTypes := flag.Bool("keep-types", false, "Emit type-annotated arguments and properties as {\"type\", \"value\"} objects")
+	flag.BoolVar(&keepTypesArgs, "keep-types-args", false, "Keep type annotations on arguments only")
+	flag.BoolVar(&keepTypesProps, "keep-types-props", false, "Keep type annotations on properties only")
+	flag.StringVar(&manifestFile, "manifest", "", "Convert and merge the KDL files listed in `FILE` (one per line, # comments) instead of the positional argument")
+	flag.BoolVar(&continueOnError, "continue-on-error", false, "With several input files, report failures and keep converting the remaining files")
+	flag.BoolVar(&rootArray, "root-array", false, "Emit a bare JSON array when every top-level node has the same name")
+	flag.BoolVar(&quiet, "quiet", false, "Suppress warnings and other informational output on stderr; errors are still reported")
+	flag.BoolVar(&commentArgNames, "comment-arg-names", false, "Name a node's arguments from the words of a // comment on its first line")
+	flag.BoolVar(&noEscapeHTML, "no-escape-html", false, "Don't escape <, > and & in JSON strings")
+	flag.StringVar(&mergeInto, "merge-into", "", "Deep-merge the converted document into the JSON in `FILE`; KDL values win on conflicts")
+	flag.StringVar(&mergeArrays, "merge-arrays", "replace", "With -merge-into, how to merge arrays present in both: replace or append")
+	flag.BoolVar(&inferSchemaOnly, "infer-schema", false, "Emit a JSON Schema inferred from the converted document instead of the document")
+	flag.StringVar(&argMode, "arg-mode", "auto", "How to emit node arguments: auto (bare values for argument-only nodes) or named (always named keys)")
+	flag.BoolVar(&argsAsObject, "args-as-object", false, "Emit argument-only nodes with several arguments as objects keyed by argument name instead of arrays")
+	flag.IntVar(&floatPrecision, "float-precision", 0, "Round floating-point values to `N` significant digits (0 = shortest exact representation)")
+	flag.StringVar(&splitArchive, "split-archive", "", "Write each top-level node to <name>.json inside the .zip, .tar.gz or .tgz archive `FILE`")
+	flag.Var(&requiredPaths, "required", "Fail unless the dotted `PATH` (e.g. server.port or item.0.name) is present in the output; repeatable")
+	flag.Var(&argTypeMappings, "arg-type", "Coerce argument `N=TYPE` to a JSON type (string, int, float, bool); repeatable")
+	flag.StringVar(&outputFile, "output", "", "Write the JSON output to `FILE` instead of stdout")
+	flag.StringVar(&relativeTo, "relative-to", "", "Resolve relative -output, -split-dir and -split-archive paths against `DIR` instead of the working directory")
+	flag.StringVar(&includeIgnoreFile, "include-ignore", "", "Skip files matching the gitignore-style patterns in `FILE` when expanding directory and glob includes")
+	flag.BoolVar(&allowInvalidUTF8, "allow-invalid-utf8", false, "Drop invalid UTF-8 sequences from input files instead of failing")
+	flag.BoolVar(&streamOutput, "stream", false, "Convert and emit top-level nodes one at a time as newline-delimited JSON, without grouping")
+	flag.BoolVar(&dedupArrays, "dedup-arrays", false, "Remove duplicate elements from arrays of same-named nodes, keeping the first occurrence")
+	flag.BoolVar(&unwrap, "unwrap", false, "Emit the value of the single top-level node instead of an object keyed by its name")
+	flag.BoolVar(&emitRootType, "emit-root-type", false, "With -unwrap, record the unwrapped node's name (and type annotation) in metadata keys")
+	flag.BoolVar(&collapseSingleChild, "collapse-single-child", false, "Convert a node whose only content is a single child node to that child's value")
+	flag.BoolVar(&collapseProperties, "collapse-properties", false, "Hoist the properties of nodes without arguments into their parent as <node><delimiter><property> keys")
+	flag.StringVar(&collapseDelimiter, "collapse-delimiter", ".", "Separator used in keys hoisted by -collapse-properties")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Cache include-expanded files in `DIR`, reusing them while the files they depend on are unchanged")
+	flag.BoolVar(&normalizeBools, "normalize-bools", false, "Convert the exact strings \"true\" and \"false\" to booleans (lossy)")
+	flag.BoolVar(&normalizeYesNo, "normalize-yes-no", false, "With -normalize-bools, also convert \"yes\" and \"no\"")
+	flag.IntVar(&maxProperties, "max-properties", 0, "Fail if any node has more than `N` properties (0 = unlimited)")
+	flag.StringVar(&includeDirective, "include-directive", "@include", "Token that starts an include directive, e.g. !import")
+	flag.BoolVar(&noTrailingNewline, "no-trailing-newline", false, "Don't end the JSON output (and split files) with a newline")
+	flag.BoolVar(&typesSidecar, "types-sidecar", false, "Collect node type annotations into a _types object mirroring the output tree")
+	flag.BoolVar(&envelope, "envelope", false, "Wrap the output as {\"meta\": {...}, \"data\": ...} recording its provenance")
+	flag.StringVar(&envelopeFields, "envelope-fields", "source,generated_at,kdlc_version", "Comma-separated `FIELDS` recorded in the -envelope metadata")
+	flag.BoolVar(&caseInsensitiveNames, "case-insensitive-names", false, "Treat node names case-insensitively, grouping Item and item under the lowercase key")
+	flag.StringVar(&explainPathFlag, "explain-path", "", "Report on stderr which KDL node, argument or property (and file:line) produced the value at dotted `PATH`")
+	flag.StringVar(&argLastName, "arg-last", "", "Name a node's last argument `NAME` regardless of its position")
+	flag.BoolVar(&warnShapeInstability, "warn-shape-instability", false, "Warn when a node name appears once in a file but several times after includes, flipping its value from object to array")
+	flag.BoolVar(&withRaw, "with-raw", false, "Emit argument and property values as {\"value\", \"raw\"} objects keeping their KDL source text")
+	flag.BoolVar(&failOnUnknownType, "fail-on-unknown-type", false, "Fail on values of unhandled types (e.g. integers too large for 64 bits) instead of emitting them as strings")
+	flag.BoolVar(&leavesOutput, "leaves", false, "Emit one {\"path\": ..., \"value\": ...} line per leaf value instead of the JSON document")
+	flag.BoolVar(&withSource, "with-source", false, "Record the file each top-level node object came from in a _source key")
+	flag.Var(&redactKeys, "redact", "Replace the value of every key named `KEY` (a glob such as *_token is allowed) with \"***\" at any depth; repeatable")
+	flag.StringVar(&schemaNodeName, "schema-node", "", "Lift the top-level node `NAME` (e.g. a (schema)version node) out of the output into a _schema key")
+	flag.Int64Var(&maxOutputSize, "max-output-size", 0, "Fail without writing anything if the output would exceed `N` bytes (0 = unlimited)")
+	flag.Var(&renameMappings, "rename", "Rename the output key at dotted path `FROM=TO` (e.g. server.port=listen_port) after conversion; repeatable")
+	flag.Var(&stringifyKeys, "stringify", "Emit the values of properties and the arguments of nodes named `KEY` (a glob is allowed) as JSON strings, as written in the KDL; repeatable")
+	flag.BoolVar(&stableShape, "stable-shape", false, "Always emit nodes with arguments as {\"args\": [...], \"props\": {...}}, so adding a property doesn't change their shape")
+	flag.StringVar(&inputGlob, "input-glob", "", "Convert every file matching `PATTERN` separately, writing <name>.json files to -split-dir")
+	flag.StringVar(&docsFile, "docs", "", "Also write the // comments documenting each node to `FILE` as JSON keyed by dotted node path")
+	flag.StringVar(&outputFormat, "format", "json", "Output `FORMAT`: json, msgpack (binary MessagePack), go (a Go source file declaring the document as a variable), or dot for a Graphviz graph of the node tree (structure only, no values)")
+	flag.StringVar(&goVarName, "go-var", "Config", "With -format go, the `NAME` of the generated variable")
+	flag.StringVar(&goPackageName, "go-package", "config", "With -format go, the `PACKAGE` of the generated source")
+	flag.StringVar(&metaCollision, "meta-collision", "warn", "When a document key equals a metadata key kdlc adds: warn (metadata wins), error, or escape (prefix the document key again)")
+	flag.Var(&argCountMappings, "args", "Require nodes named `NAME=MIN..MAX` to have between MIN and MAX arguments (N, MIN.. and ..MAX also work); repeatable")
+	flag.BoolVar(&preserveNumberFormat, "preserve-number-format", false, "Emit hex, octal and binary numbers and numbers with _ separators as strings of their KDL source text")
+	flag.StringVar(&depFile, "depfile", "", "Write a Makefile rule making -output depend on the input and every file it includes to `PATH`")
+	flag.BoolVar(&flattenArgs, "flatten-args", false, "Put the only argument of a node with properties or children under -flatten-args-key instead of arg1")
+	flag.StringVar(&flattenArgsKey, "flatten-args-key", "value", "Key for the only argument of a node with -flatten-args")
+	flag.IntVar(&parallelJobs, "parallel", 1, "Convert up to `N` -input-glob files concurrently")
+	flag.BoolVar(&hashOutput, "hash", false, "Print the SHA-256 hash of the canonical (RFC 8785) form of the converted document to stderr")
+	flag.BoolVar(&numericArrays, "numeric-arrays", false, "Convert a body whose child nodes are named \"0\" to \"n-1\" (each once) to an array in index order")
+	flag.Var(&aliasMappings, "alias", "Treat nodes named `FROM=TO` as if they were named TO (e.g. colour=color), so aliases group together; repeatable")
+	flag.BoolVar(&lintIndentation, "lint-indentation", false, "Warn about lines of the input and included files that mix tab and space indentation")
+	flag.IntVar(&maxLineLength, "max-line-length", 0, "Warn about lines of the input and included files longer than `N` characters (0 = no limit)")
+	flag.BoolVar(&childrenAsList, "children-as-list", false, "Emit each node's children as an array of {\"name\", \"value\"} objects in document order instead of keys grouped by name")
+	flag.StringVar(&stripPrefix, "strip-prefix", "", "Remove `PREFIX` from the start of every output key that has it (e.g. cfg_), failing if two keys would clash")
+	flag.StringVar(&schemaFile, "schema", "", "JSON Schema `FILE` describing the output, used by -emit-defaults")
+	flag.BoolVar(&emitDefaults, "emit-defaults", false, "Add the default of every -schema property missing from the output, so consumers get a fully populated document")
+	flag.BoolVar(&resolveSymlinks, "resolve-symlinks", false, "Resolve symlinks when identifying included files, so a file reached through different links is detected as a cycle or duplicate")
+	flag.BoolVar(&forceBinary, "force-binary", false, "Write -format msgpack output to stdout even when it is a terminal")
+	flag.StringVar(&onDuplicateProperty, "on-duplicate-property", "last-wins", "When a node sets a property more than once: last-wins, first-wins, array (all values in order), or error")
+	flag.StringVar(&fromPath, "from-path", "", "Convert only the node at dotted `PATH` (e.g. scene.node, or item.1 for the second item node) and emit its value")
+	flag.BoolVar(&noGroup, "no-group", false, "Never group same-named nodes into arrays; the last node with a name wins")
+	flag.StringVar(&configFile, "config", "", "Read default flag values from `FILE` (KDL, or JSON if it ends in .json) instead of .kdlc.kdl or .kdlc.json in the working directory")
+	flag.StringVar(&lineMapFile, "line-map", "", "Also write the file, line and column each output path (e.g. scene.node.x) comes from to `PATH` as JSON")
+	flag.Var(&keyByMappings, "key-by", "Convert the nodes named `NODE=PROP` (e.g. item=name) to an object keyed by the value of their PROP property instead of an array; repeatable")
+	flag.BoolVar(&emptyOK, "empty-ok", true, "Emit an empty result ({}, [] or null, e.g. after -from-path or -omit-empty) normally; with -empty-ok=false it is an error")
+	flag.BoolVar(&nullInput, "null-input", false, "Read no input file and produce the output from -transform alone, with environment variables bound as env")
+	flag.Var(&transformVarMappings, "var", "Bind the string variable `NAME=VALUE` in -transform expressions; repeatable")
+	flag.StringVar(&nodeFilterExpr, "node-filter", "", "Convert only nodes for which the expr-lang predicate `EXPR` is true (with name, args, props, children and depth bound)")
+	flag.StringVar(&transformExpr, "transform", "", "Replace the output with the result of the expr-lang `EXPR` evaluated on the converted document (bound as doc, with top-level keys as variables)")
 
 	flag.Parse()
 
+	// Flags given on the command line override the config file
+	if err := applyConfig(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	if quiet {
+		warnOutput = io.Discard
+	}
+
+	if *keepTypes {
+		keepTypesArgs = true
+		keepTypesProps = true
+	}
+
+	for _, unit := range strings.Split(unitNames, ",") {
+		if unit = strings.TrimSpace(unit); unit != "" {
+			unitTypes[unit] = true
+		}
+	}
+
 	// Update the argument name mapping
 	argNameMap[1] = *arg1Name
 	argNameMap[2] = *arg2Name
@@ -48,212 +674,5082 @@ func main() {
 	argNameMap[5] = *arg5Name
 
 	// Check if filename is provided
-	if flag.NArg() < 1 {
+	if flag.NArg() < 1 && manifestFile == "" && inputGlob == "" && !nullInput {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <kdl-file>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	filename := flag.Arg(0)
-
-	// Process includes and read KDL file
-	data, err := processIncludes(filename, make(map[string]bool))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error processing includes: %v\n", err)
-		os.Exit(1)
+	if maxLineLength < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-line-length must not be negative\n")
+		os.Exit(exitUsage)
 	}
 
-	// Parse KDL
-	doc, err := kdl.Parse(strings.NewReader(string(data)))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing KDL: %v\n", err)
-		os.Exit(1)
+	if floatPrecision < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -float-precision must not be negative\n")
+		os.Exit(exitUsage)
 	}
 
-	// Convert to JSON
-	jsonData, err := convertKDLToJSON(doc)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error converting to JSON: %v\n", err)
-		os.Exit(1)
+	if strings.TrimSpace(includeDirective) == "" || strings.ContainsAny(includeDirective, " \t\"") {
+		fmt.Fprintf(os.Stderr, "Error: invalid -include-directive %q\n", includeDirective)
+		os.Exit(exitUsage)
 	}
 
-	// Output JSON
-	fmt.Println(string(jsonData))
-}
-
-// processIncludes processes @include directives in KDL files
-func processIncludes(filename string, included map[string]bool) (string, error) {
-	// Check for circular includes
-	absPath, err := filepath.Abs(filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to get absolute path for %s: %v", filename, err)
+	if envelope {
+		if _, err := envelopeMeta(nil, time.Time{}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitUsage)
+		}
 	}
 
-	if included[absPath] {
-		return "", fmt.Errorf("circular include detected: %s", filename)
+	for _, pattern := range redactKeys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -redact pattern %q: %v\n", pattern, err)
+			os.Exit(exitUsage)
+		}
 	}
-	included[absPath] = true
-
-	// Read the file
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to read file %s: %v", filename, err)
+	for _, pattern := range stringifyKeys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -stringify pattern %q: %v\n", pattern, err)
+			os.Exit(exitUsage)
+		}
 	}
 
-	content := string(data)
-
-	// Check if file contains @include directives
-	if !strings.Contains(content, "@include") {
-		// No includes, return content as-is
-		return content, nil
+	if maxOutputSize < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-output-size must not be negative\n")
+		os.Exit(exitUsage)
+	}
+	if maxOutputSize > 0 && streamOutput {
+		fmt.Fprintf(os.Stderr, "Error: -max-output-size cannot be used with -stream\n")
+		os.Exit(exitUsage)
 	}
 
-	lines := strings.Split(content, "\n")
-	var result []string
-
-	// Process each line for @include directives
-	includeRegex := regexp.MustCompile(`^\s*@include\s+"([^"]+)"`)
+	if parallelJobs < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -parallel must be at least 1\n")
+		os.Exit(exitUsage)
+	}
 
-	for _, line := range lines {
-		if matches := includeRegex.FindStringSubmatch(line); matches != nil {
-			includeFile := matches[1]
+	if flattenArgs && flattenArgsKey == "" {
+		fmt.Fprintf(os.Stderr, "Error: -flatten-args-key must not be empty\n")
+		os.Exit(exitUsage)
+	}
 
-			// Resolve relative path
-			dir := filepath.Dir(filename)
-			includePath := filepath.Join(dir, includeFile)
+	switch metaCollision {
+	case "warn", "error", "escape":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -meta-collision value %q (want warn, error or escape)\n", metaCollision)
+		os.Exit(exitUsage)
+	}
 
-			// Process the included file
-			includedContent, err := processIncludes(includePath, included)
-			if err != nil {
-				return "", fmt.Errorf("failed to process include %s: %v", includeFile, err)
+	// Streamed nodes are written one {name: value} object at a time, so options that reshape
+	// or post-process the whole document don't apply
+	if streamOutput {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"-root-array", rootArray},
+			{"-unwrap", unwrap},
+			{"-transform", transformExpr != ""},
+			{"-rename", len(renameMappings) > 0},
+			{"-strip-prefix", stripPrefix != ""},
+			{"-required", len(requiredPaths) > 0},
+			{"-emit-defaults", emitDefaults},
+			{"-infer-schema", inferSchemaOnly},
+			{"-canonicalize", canonicalize},
+			{"-envelope", envelope},
+			{"-hash", hashOutput},
+			{"-leaves", leavesOutput},
+			{"-split-dir", splitDir != ""},
+			{"-split-archive", splitArchive != ""},
+			{"-merge-into", mergeInto != ""},
+		} {
+			if option.set {
+				fmt.Fprintf(os.Stderr, "Error: -stream cannot be used with %s\n", option.name)
+				os.Exit(exitUsage)
 			}
-
-			// Add the included content
-			result = append(result, includedContent)
-		} else {
-			result = append(result, line)
 		}
 	}
 
-	return strings.Join(result, "\n"), nil
-}
+	if fromPath != "" && (streamOutput || rootArray || unwrap) {
+		fmt.Fprintf(os.Stderr, "Error: -from-path cannot be used with -stream, -root-array or -unwrap\n")
+		os.Exit(exitUsage)
+	}
 
-func convertKDLToJSON(doc *document.Document) ([]byte, error) {
-	// Convert KDL document to a map structure
-	result := make(map[string]interface{})
+	if preserveIncludeBoundaries && (streamOutput || rootArray || unwrap || fromPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -preserve-include-boundaries cannot be used with -stream, -root-array, -unwrap or -from-path\n")
+		os.Exit(exitUsage)
+	}
 
-	// Group nodes by name to handle duplicates
-	nodeGroups := make(map[string][]*document.Node)
-	for _, node := range doc.Nodes {
-		key := node.Name.NodeNameString()
-		nodeGroups[key] = append(nodeGroups[key], node)
+	switch onDuplicateProperty {
+	case "last-wins", "first-wins", "array", "error":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -on-duplicate-property value %q (want last-wins, first-wins, array or error)\n", onDuplicateProperty)
+		os.Exit(exitUsage)
 	}
 
-	// Process each group
-	for key, nodes := range nodeGroups {
-		if len(nodes) == 1 {
-			// Single node
-			result[key] = convertNodeToValue(nodes[0])
-		} else {
-			// Multiple nodes with same name - create array
-			nodeArray := make([]interface{}, len(nodes))
-			for i, node := range nodes {
-				nodeArray[i] = convertNodeToValue(node)
-			}
-			result[key] = nodeArray
+	switch outputFormat {
+	case "json", "dot":
+	case "msgpack", "go":
+		if leavesOutput || streamOutput || inputGlob != "" || splitDir != "" || splitArchive != "" {
+			fmt.Fprintf(os.Stderr, "Error: -format %s cannot be used with -leaves, -stream, -input-glob, -split-dir or -split-archive\n", outputFormat)
+			os.Exit(exitUsage)
 		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -format value %q (want json, msgpack, go or dot)\n", outputFormat)
+		os.Exit(exitUsage)
 	}
 
-	return json.MarshalIndent(result, "", "  ")
-}
+	if outputFormat == "go" && (!token.IsIdentifier(goVarName) || !token.IsIdentifier(goPackageName)) {
+		fmt.Fprintf(os.Stderr, "Error: -go-var and -go-package must be Go identifiers\n")
+		os.Exit(exitUsage)
+	}
 
-func convertNodeToValue(node *document.Node) interface{} {
-	// If node has children, convert to object
-	if len(node.Children) > 0 {
-		obj := make(map[string]interface{})
+	if mergeArrays != "replace" && mergeArrays != "append" {
+		fmt.Fprintf(os.Stderr, "Error: invalid -merge-arrays value %q (want replace or append)\n", mergeArrays)
+		os.Exit(exitUsage)
+	}
 
-		// Add node arguments as configured argument names
-		if len(node.Arguments) > 0 {
-			for i, arg := range node.Arguments {
-				argKey := getArgName(i + 1)
-				obj[argKey] = convertValue(arg)
-			}
-		}
+	if argMode != "auto" && argMode != "named" {
+		fmt.Fprintf(os.Stderr, "Error: invalid -arg-mode value %q (want auto or named)\n", argMode)
+		os.Exit(exitUsage)
+	}
 
-		// Add node properties directly (flatten the structure)
-		if len(node.Properties) > 0 {
-			for name, value := range node.Properties {
-				obj[name] = convertValue(value)
-			}
-		}
+	if err := applyResolverMappings(resolverMappings); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
 
-		// Convert children
-		childGroups := make(map[string][]*document.Node)
-		for _, child := range node.Children {
-			childKey := child.Name.NodeNameString()
-			childGroups[childKey] = append(childGroups[childKey], child)
+	if includeIgnoreFile != "" {
+		rules, err := loadIgnoreFile(includeIgnoreFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitFailure)
 		}
+		includeIgnoreRules = rules
+	}
 
-		// Process child groups
-		for childKey, childNodes := range childGroups {
-			if len(childNodes) == 1 {
-				obj[childKey] = convertNodeToValue(childNodes[0])
-			} else {
-				childArray := make([]interface{}, len(childNodes))
-				for i, childNode := range childNodes {
-					childArray[i] = convertNodeToValue(childNode)
-				}
-				obj[childKey] = childArray
-			}
-		}
+	if err := applyArgTypeMappings(argTypeMappings); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
 
-		return obj
+	if err := applyArgCountMappings(argCountMappings); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
 	}
 
-	// If node has properties, convert to object with properties and arguments
-	if len(node.Properties) > 0 {
-		obj := make(map[string]interface{})
+	if err := applyRenameMappings(renameMappings); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
 
-		// Add arguments as configured argument names if present
-		if len(node.Arguments) > 0 {
-			for i, arg := range node.Arguments {
-				argKey := getArgName(i + 1)
-				obj[argKey] = convertValue(arg)
-			}
-		}
+	if err := applyAliasMappings(aliasMappings); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
 
-		// Add properties directly (flatten the structure)
-		for name, value := range node.Properties {
-			obj[name] = convertValue(value)
+	if err := applyKeyByMappings(keyByMappings); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	if transformExpr != "" {
+		program, err := expr.Compile(transformExpr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -transform expression: %v\n", err)
+			os.Exit(exitUsage)
 		}
+		transformProgram = program
+	}
 
-		return obj
+	for _, mapping := range transformVarMappings {
+		name, value, ok := strings.Cut(mapping, "=")
+		if !ok || name == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid -var %q (expected NAME=VALUE)\n", mapping)
+			os.Exit(exitUsage)
+		}
+		transformVars[name] = value
 	}
 
-	// If node has multiple arguments, return as array
-	if len(node.Arguments) > 1 {
-		args := make([]interface{}, len(node.Arguments))
-		for i, arg := range node.Arguments {
-			args[i] = convertValue(arg)
+	if nullInput {
+		switch {
+		case transformExpr == "":
+			fmt.Fprintf(os.Stderr, "Error: -null-input requires -transform\n")
+			os.Exit(exitUsage)
+		case flag.NArg() > 0 || manifestFile != "" || inputGlob != "":
+			fmt.Fprintf(os.Stderr, "Error: -null-input does not read input files\n")
+			os.Exit(exitUsage)
+		case listIncludesOnly || validateIncludesOnly || explainPathFlag != "" || depFile != "" || docsFile != "" || lineMapFile != "" || streamOutput || outputFormat == "dot":
+			fmt.Fprintf(os.Stderr, "Error: -null-input cannot be used with options that inspect the input file\n")
+			os.Exit(exitUsage)
 		}
-		return args
 	}
 
-	// If node has single argument, return the value directly
-	if len(node.Arguments) == 1 {
-		return convertValue(node.Arguments[0])
+	if nodeFilterExpr != "" {
+		program, err := expr.Compile(nodeFilterExpr, expr.AsBool())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -node-filter expression: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		nodeFilterProgram = program
 	}
 
-	// Empty node
+	if emitDefaults && schemaFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: -emit-defaults requires -schema\n")
+		os.Exit(exitUsage)
+	}
+	if schemaFile != "" {
+		schema, err := loadSchema(schemaFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading schema %s: %v\n", schemaFile, err)
+			os.Exit(exitFailure)
+		}
+		outputSchema = schema
+	}
+
+	outputFile = resolveOutputPath(outputFile)
+	splitDir = resolveOutputPath(splitDir)
+	splitArchive = resolveOutputPath(splitArchive)
+	docsFile = resolveOutputPath(docsFile)
+	lineMapFile = resolveOutputPath(lineMapFile)
+	depFile = resolveOutputPath(depFile)
+
+	useColor, err := shouldColorize(colorMode, outputFile == "" && isTerminal(os.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	filename := flag.Arg(0)
+
+	// Only resolve the include graph when listing includes
+	if listIncludesOnly {
+		var files []string
+		var err error
+		if manifestFile != "" {
+			files, err = listManifestIncludes(manifestFile)
+		} else {
+			files, err = listIncludes(filename)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing includes: %v\n", err)
+			os.Exit(exitInclude)
+		}
+		for _, file := range files {
+			fmt.Println(file)
+		}
+		return
+	}
+
+	// Resolve the include graph of every input as a fast pre-flight check
+	if validateIncludesOnly {
+		var err error
+		switch {
+		case manifestFile != "":
+			_, _, err = manifestSource(manifestFile, newIncludeState())
+		case inputGlob != "":
+			var matches []string
+			if matches, err = globInputs(inputGlob); err == nil {
+				err = validateIncludes(matches)
+			}
+		default:
+			err = validateIncludes(flag.Args())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing includes: %v\n", err)
+			os.Exit(exitInclude)
+		}
+		return
+	}
+
+	// Trace an output value back to its source
+	if explainPathFlag != "" {
+		if err := runExplainPath(filename, explainPathFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error explaining %s: %v\n", explainPathFlag, err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	// Record the include graph for build systems
+	if depFile != "" {
+		if err := writeDepFile(depFile, outputFile, filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing depfile: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	// Write the documentation sidecar next to the output
+	if docsFile != "" {
+		if err := runDocs(filename, docsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing docs: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	// Write the source map for editors next to the output
+	if lineMapFile != "" {
+		if err := runLineMap(filename, lineMapFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing line map: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	// Convert each matching file on its own
+	if inputGlob != "" {
+		failures, err := convertGlob(inputGlob, splitDir, os.Stderr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if failures > 0 {
+			os.Exit(exitFailure)
+		}
+		return
+	}
+
+	// Draw the node structure instead of converting values
+	if outputFormat == "dot" {
+		if err := runGraph(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	// Stream top-level nodes without building the whole document
+	if streamOutput {
+		if err := runStream(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	// Convert the input: the manifest, a single file, or several files keyed by name
+	var result interface{}
+	failStatus := 0 // exit status after writing partial output with -continue-on-error
+	switch {
+	case nullInput:
+		// The transform builds the output from nothing
+	case manifestFile != "":
+		data, origins, err := manifestSource(manifestFile, newIncludeState())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing includes: %v\n", err)
+			os.Exit(exitInclude)
+		}
+		if warnShapeInstability {
+			checkShapeStability(data, origins)
+		}
+		result, err = convertIncludeSource(data, origins)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	case flag.NArg() == 1:
+		result, err = convertFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	default:
+		var errs []error
+		result, errs = convertFiles(flag.Args())
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		}
+		if len(errs) > 0 {
+			if !continueOnError {
+				os.Exit(exitCode(errs[0]))
+			}
+			failStatus = exitCode(errs[0])
+		}
+	}
+
+	// Rename keys to what the consumer expects
+	if err := stripKeyPrefix(result, stripPrefix, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitConversion)
+	}
+	if err := renameKeys(result, renames); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitConversion)
+	}
+
+	// Fill in what the schema says an omitted property defaults to
+	if emitDefaults {
+		applySchemaDefaults(result, outputSchema)
+	}
+
+	// Reshape the document with the user's expression
+	if result, err = applyTransform(result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitConversion)
+	}
+
+	// Check required keys before anything is written
+	if missing := missingPaths(result, requiredPaths); len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: missing required keys: %s\n", strings.Join(missing, ", "))
+		os.Exit(exitConversion)
+	}
+	if err := checkEmptyResult(result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitConversion)
+	}
+
+	// Merge into an existing JSON document
+	if mergeInto != "" {
+		result, err = mergeIntoFile(mergeInto, result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error merging into %s: %v\n", mergeInto, err)
+			os.Exit(exitFailure)
+		}
+	}
+
+	// Describe the document instead of emitting it
+	if inferSchemaOnly {
+		result = inferSchema(result)
+	}
+
+	// Identify the content independently of formatting
+	if hashOutput {
+		sum, err := contentHash(result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error hashing output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		fmt.Fprintf(os.Stderr, "sha256:%s\n", sum)
+	}
+
+	// Flatten to path/value records
+	if leavesOutput {
+		lines, err := leafLines(result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error converting to JSON: %v\n", err)
+			os.Exit(exitConversion)
+		}
+		if err := writeOutput(lines); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if failStatus != 0 {
+			os.Exit(failStatus)
+		}
+		return
+	}
+
+	// Write per-node files when splitting
+	if splitDir != "" || splitArchive != "" {
+		obj, ok := result.(map[string]interface{})
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error writing split output: -split-dir and -split-archive require an object at the document root\n")
+			os.Exit(exitFailure)
+		}
+		if splitDir != "" {
+			err = writeSplitFiles(splitDir, obj)
+		} else {
+			err = writeSplitArchive(splitArchive, obj)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing split output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if failStatus != 0 {
+			os.Exit(failStatus)
+		}
+		return
+	}
+
+	// Record provenance around the payload
+	if envelope {
+		sources := flag.Args()
+		if manifestFile != "" {
+			sources = []string{manifestFile}
+		}
+		meta, err := envelopeMeta(sources, generationTime())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		result = map[string]interface{}{"meta": meta, "data": result}
+	}
+
+	// Encode as MessagePack, refusing to dump binary data on a terminal
+	if outputFormat == "msgpack" {
+		if outputFile == "" && isTerminal(os.Stdout) && !forceBinary {
+			fmt.Fprintf(os.Stderr, "Error: refusing to write binary MessagePack to a terminal (use -output or -force-binary)\n")
+			os.Exit(exitUsage)
+		}
+		data, err := encodeMsgpack(result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error converting to MessagePack: %v\n", err)
+			os.Exit(exitConversion)
+		}
+		if err := writeBinaryOutput(data); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if failStatus != 0 {
+			os.Exit(failStatus)
+		}
+		return
+	}
+
+	// Declare the document in Go source
+	if outputFormat == "go" {
+		data, err := encodeGo(result, goPackageName, goVarName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error converting to Go: %v\n", err)
+			os.Exit(exitConversion)
+		}
+		// The source is already gofmt-formatted, final newline included
+		if err := writeBinaryOutput(data); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		if failStatus != 0 {
+			os.Exit(failStatus)
+		}
+		return
+	}
+
+	// Convert to JSON
+	jsonData, err := encodeJSON(result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error converting to JSON: %v\n", err)
+		os.Exit(exitConversion)
+	}
+
+	// Output JSON (canonical output is emitted byte-exact, without colors)
+	if useColor && !canonicalize {
+		jsonData = colorizeJSON(jsonData)
+	}
+	if err := writeOutput(jsonData); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	if failStatus != 0 {
+		os.Exit(failStatus)
+	}
+}
+
+// encodeGo renders result as a gofmt-formatted Go source file in package pkg that declares it
+// as the variable name, with objects as map[string]interface{} and arrays as []interface{}
+func encodeGo(result interface{}, pkg, name string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by kdlc. DO NOT EDIT.\n\npackage %s\n\nvar %s = ", pkg, name)
+	if result == nil {
+		// A bare nil has no type to declare the variable with
+		buf.WriteString("interface{}(nil)")
+	} else if err := appendGoValue(&buf, result); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return format.Source(buf.Bytes())
+}
+
+// appendGoValue writes v to buf as a Go expression, sorting object keys
+func appendGoValue(buf *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("nil")
+	case bool:
+		buf.WriteString(strconv.FormatBool(x))
+	case int:
+		buf.WriteString(strconv.Itoa(x))
+	case int64:
+		buf.WriteString(strconv.FormatInt(x, 10))
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return fmt.Errorf("cannot encode non-finite number %v", x)
+		}
+		// Integral floats keep a decimal point so they stay float64
+		text := strconv.FormatFloat(x, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		buf.WriteString(text)
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return appendGoValue(buf, n)
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return fmt.Errorf("invalid number %s: %v", x, err)
+		}
+		return appendGoValue(buf, f)
+	case string:
+		buf.WriteString(strconv.Quote(x))
+	case []interface{}:
+		buf.WriteString("[]interface{}{\n")
+		for _, item := range x {
+			if err := appendGoValue(buf, item); err != nil {
+				return err
+			}
+			buf.WriteString(",\n")
+		}
+		buf.WriteString("}")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteString("map[string]interface{}{\n")
+		for _, key := range keys {
+			buf.WriteString(strconv.Quote(key) + ": ")
+			if err := appendGoValue(buf, x[key]); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			buf.WriteString(",\n")
+		}
+		buf.WriteString("}")
+	default:
+		return fmt.Errorf("cannot encode value of type %T", v)
+	}
+	return nil
+}
+
+// encodeJSON serializes the converted document, canonically with -canonicalize
+func encodeJSON(result interface{}) ([]byte, error) {
+	if canonicalize {
+		return canonicalJSON(result)
+	}
+	return marshalJSON(result)
+}
+
+// contentHash returns the hex SHA-256 of the canonical JSON of result, which is the same for
+// equal documents whatever the output formatting options
+func contentHash(result interface{}) (string, error) {
+	canonical, err := canonicalJSON(result)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeOutput writes the final JSON to -output or stdout
+func writeOutput(jsonData []byte) error {
+	jsonData = terminateOutput(jsonData)
+	if err := checkOutputSize(int64(len(jsonData))); err != nil {
+		return err
+	}
+	if outputFile != "" {
+		return os.WriteFile(outputFile, jsonData, 0644)
+	}
+	_, err := os.Stdout.Write(jsonData)
+	return err
+}
+
+// writeBinaryOutput writes binary output to -output or stdout as is, without a trailing newline
+func writeBinaryOutput(data []byte) error {
+	if err := checkOutputSize(int64(len(data))); err != nil {
+		return err
+	}
+	if outputFile != "" {
+		return os.WriteFile(outputFile, data, 0644)
+	}
+	_, err := os.Stdout.Write(data)
+	return err
+}
+
+// encodeMsgpack encodes the converted document as MessagePack, using the smallest encoding of
+// each value and writing object keys in sorted order so equal documents give equal bytes
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	return appendMsgpack(nil, v)
+}
+
+// appendMsgpack appends the MessagePack encoding of v to buf
+func appendMsgpack(buf []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if x {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendMsgpackInt(buf, int64(x)), nil
+	case int64:
+		return appendMsgpackInt(buf, x), nil
+	case float64:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(x)), nil
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return appendMsgpackInt(buf, n), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s: %v", x, err)
+		}
+		return appendMsgpack(buf, f)
+	case string:
+		buf = appendMsgpackHeader(buf, len(x), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(buf, x...), nil
+	case []interface{}:
+		buf = appendMsgpackHeader(buf, len(x), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range x {
+			var err error
+			if buf, err = appendMsgpack(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf = appendMsgpackHeader(buf, len(x), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			var err error
+			if buf, err = appendMsgpack(buf, key); err != nil {
+				return nil, err
+			}
+			if buf, err = appendMsgpack(buf, x[key]); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("cannot encode value of type %T", v)
+	}
+}
+
+// appendMsgpackInt appends n in the smallest MessagePack integer format that holds it
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n >= -32 && n < 0:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+	}
+}
+
+// appendMsgpackHeader appends the header of a string, array or map of length n: the fixed
+// format (fixed|n) below fixedLimit, then the 8-bit (if the type has one), 16-bit and 32-bit
+// length formats
+func appendMsgpackHeader(buf []byte, n int, fixed byte, fixedLimit int, code8, code16, code32 byte) []byte {
+	switch {
+	case n < fixedLimit:
+		return append(buf, fixed|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		return append(buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, code32), uint32(n))
+	}
+}
+
+// checkOutputSize enforces -max-output-size on output of size bytes
+func checkOutputSize(size int64) error {
+	if maxOutputSize > 0 && size > maxOutputSize {
+		return fmt.Errorf("output is %d bytes, exceeding -max-output-size of %d", size, maxOutputSize)
+	}
+	return nil
+}
+
+// leaf is one record of -leaves output
+type leaf struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// joinPath appends segment to the dotted path, which is empty at the root
+func joinPath(path, segment string) string {
+	if path == "" {
+		return segment
+	}
+	return path + "." + segment
+}
+
+// collectLeaves walks v depth-first and returns its leaves with dotted paths in the style
+// of -required, using numeric segments for array elements and sorted object keys. Empty
+// objects and arrays are leaves themselves, so every key in the document has a record.
+func collectLeaves(v interface{}, path string, leaves []leaf) []leaf {
+	join := func(segment string) string {
+		return joinPath(path, segment)
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if len(x) == 0 {
+			break
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			leaves = collectLeaves(x[k], join(k), leaves)
+		}
+		return leaves
+	case []interface{}:
+		if len(x) == 0 {
+			break
+		}
+		for i, item := range x {
+			leaves = collectLeaves(item, join(strconv.Itoa(i)), leaves)
+		}
+		return leaves
+	}
+	return append(leaves, leaf{Path: path, Value: v})
+}
+
+// leafLines renders the leaves of result as newline-delimited JSON, without a final newline
+func leafLines(result interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(!noEscapeHTML)
+	for _, l := range collectLeaves(result, "", nil) {
+		if err := encoder.Encode(l); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// terminateOutput appends the trailing newline unless -no-trailing-newline is set
+func terminateOutput(data []byte) []byte {
+	if noTrailingNewline {
+		return data
+	}
+	return append(data, '\n')
+}
+
+// envelopeMeta builds the metadata object for -envelope from the -envelope-fields list
+func envelopeMeta(sources []string, now time.Time) (map[string]interface{}, error) {
+	meta := make(map[string]interface{})
+	for _, field := range strings.Split(envelopeFields, ",") {
+		switch field = strings.TrimSpace(field); field {
+		case "":
+		case "source":
+			if len(sources) == 1 {
+				meta["source"] = sources[0]
+			} else {
+				meta["source"] = sources
+			}
+		case "generated_at":
+			meta["generated_at"] = now.UTC().Format(time.RFC3339)
+		case "kdlc_version":
+			meta["kdlc_version"] = version
+		default:
+			return nil, fmt.Errorf("unknown envelope field %q (available: source, generated_at, kdlc_version)", field)
+		}
+	}
+	return meta, nil
+}
+
+// generationTime returns the current time, or SOURCE_DATE_EPOCH when set for reproducible builds
+func generationTime() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if seconds, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(seconds, 0)
+		}
+		warnf("ignoring invalid SOURCE_DATE_EPOCH %q", epoch)
+	}
+	return time.Now()
+}
+
+// resolveOutputPath resolves a relative output path against -relative-to, if set
+func resolveOutputPath(path string) string {
+	if path == "" || relativeTo == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(relativeTo, path)
+}
+
+// convertFile processes includes in filename, then parses and converts the result.
+// Errors are prefixed with the stage that failed.
+func convertFile(filename string) (interface{}, error) {
+	data, origins, err := includeSource(filename, newIncludeState())
+	if err != nil {
+		return nil, includeError(err)
+	}
+	if warnShapeInstability {
+		checkShapeStability(data, origins)
+	}
+	return convertIncludeSource(data, origins)
+}
+
+// convertIncludeSource converts include-expanded data, one section per file with
+// -preserve-include-boundaries
+func convertIncludeSource(data string, origins []lineOrigin) (interface{}, error) {
+	if !preserveIncludeBoundaries {
+		return convertSourceOrigins(data, origins)
+	}
+
+	// Top-level nodes belong to the file their first line came from
+	type section struct {
+		chunks  []string
+		origins []lineOrigin
+	}
+	sections := make(map[string]*section)
+	var order []string
+	for _, info := range scanNodes(data) {
+		// Nodes end after their terminating newline, which the join restores
+		chunk := strings.TrimRight(data[info.start:info.end], "\r\n")
+		first := strings.Count(data[:info.start], "\n")
+		count := strings.Count(chunk, "\n") + 1
+		if first+count > len(origins) {
+			return nil, conversionError(fmt.Errorf("-preserve-include-boundaries: cannot tell which file the node at line %d came from", info.line))
+		}
+		key := displayPath(origins[first].File)
+		s, ok := sections[key]
+		if !ok {
+			s = &section{}
+			sections[key] = s
+			order = append(order, key)
+		}
+		s.chunks = append(s.chunks, chunk)
+		s.origins = append(s.origins, origins[first:first+count]...)
+	}
+
+	result := make(map[string]interface{})
+	for _, key := range order {
+		s := sections[key]
+		value, err := convertSourceOrigins(strings.Join(s.chunks, "\n"), s.origins)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// checkShapeStability warns about groups of same-named nodes that span several files with
+// a single node in at least one of them: converted on its own, that file yields an object
+// where the merged document yields an array.
+func checkShapeStability(data string, origins []lineOrigin) {
+	doc, err := kdl.Parse(strings.NewReader(data))
+	if err != nil {
+		return // reported by the conversion itself
+	}
+	infos := matchNodeInfo(doc.Nodes, scanNodes(data))
+
+	regular, _ := splitDefaults(doc.Nodes)
+	checkGroupShapes(infos, regular, "", origins)
+}
+
+// checkGroupShapes checks the groups of nodes at one level, then their children
+func checkGroupShapes(infos nodeInfos, nodes []*document.Node, prefix string, origins []lineOrigin) {
+	groups := make(map[string][]*document.Node)
+	var order []string
+	for _, node := range nodes {
+		key := nodeKey(node)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], node)
+	}
+
+	for _, key := range order {
+		group := groups[key]
+		path := prefix + key
+
+		if len(group) > 1 {
+			counts := make(map[string]int)
+			var files []string
+			for _, node := range group {
+				info := infos[node]
+				if info == nil || info.line-1 >= len(origins) {
+					continue
+				}
+				file := origins[info.line-1].File
+				if counts[file] == 0 {
+					files = append(files, file)
+				}
+				counts[file]++
+			}
+			if len(files) > 1 {
+				for _, file := range files {
+					if counts[file] == 1 {
+						warnf("node %q appears once in %s but %d times after includes, so it converts to an object or an array depending on what is included", path, displayPath(file), len(group))
+						break
+					}
+				}
+			}
+		}
+
+		for i, node := range group {
+			childPrefix := path + "."
+			if len(group) > 1 {
+				childPrefix = fmt.Sprintf("%s.%d.", path, i)
+			}
+			checkGroupShapes(infos, node.Children, childPrefix, origins)
+		}
+	}
+}
+
+// stageError is an error from one stage of processing, which decides the exit status
+type stageError struct {
+	code int
+	err  error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+
+func (e *stageError) Unwrap() error { return e.err }
+
+// includeError reports a failure to expand the includes of the input
+func includeError(err error) error {
+	return &stageError{code: exitInclude, err: fmt.Errorf("processing includes: %v", err)}
+}
+
+// parseError reports input that is not valid KDL
+func parseError(err error) error {
+	return &stageError{code: exitParse, err: fmt.Errorf("parsing KDL: %v", err)}
+}
+
+// conversionError reports a document that parsed but could not be converted
+func conversionError(err error) error {
+	return &stageError{code: exitConversion, err: fmt.Errorf("converting to JSON: %v", err)}
+}
+
+// exitCode returns the exit status for err: that of the stage it came from, or exitFailure
+func exitCode(err error) int {
+	var stage *stageError
+	if errors.As(err, &stage) {
+		return stage.code
+	}
+	return exitFailure
+}
+
+// convertSource parses KDL source and converts it to the output structure
+func convertSource(data string) (interface{}, error) {
+	return convertSourceOrigins(data, nil)
+}
+
+// convertSourceOrigins converts data like convertSource. origins gives the file and line of
+// every line of data, as returned by includeSource, and is used by -with-source.
+func convertSourceOrigins(data string, origins []lineOrigin) (interface{}, error) {
+	doc, err := kdl.Parse(strings.NewReader(data))
+	if err != nil {
+		return nil, parseError(err)
+	}
+	return convertParsedSource(doc, data, origins)
+}
+
+// convertParsedSource converts doc, already parsed from data, like convertSourceOrigins
+func convertParsedSource(doc *document.Document, data string, origins []lineOrigin) (interface{}, error) {
+	var err error
+
+	// Recover comments and positions the parser discards
+	scopedArgNames := hasArgNameScopes(origins)
+	var infos nodeInfos
+	if commentArgNames || (withSource && origins != nil) || len(argCounts) > 0 || preserveNumberFormat || len(stringifyKeys) > 0 || scopedArgNames || onDuplicateProperty != "last-wins" {
+		infos = matchNodeInfo(doc.Nodes, scanNodes(data))
+	}
+	if scopedArgNames {
+		markNodeArgNames(infos, doc.Nodes, origins)
+	}
+	if len(argCounts) > 0 {
+		markNodeLocations(infos, doc.Nodes, origins)
+	}
+	if withSource {
+		markNodeSources(infos, doc.Nodes, origins)
+	}
+	if nodeFilterProgram != nil {
+		if doc.Nodes, err = filterNodes(doc.Nodes, 0); err != nil {
+			return nil, conversionError(err)
+		}
+	}
+
+	// Root the conversion at a single node
+	if fromPath != "" {
+		node, err := findNodePath(doc.Nodes, fromPath)
+		if err != nil {
+			return nil, conversionError(err)
+		}
+		value, err := convertNodeToValue(infos, node)
+		if err != nil {
+			return nil, conversionError(wrapNodeError(fromPath, err))
+		}
+		return postProcessValue(value), nil
+	}
+
+	converted, err := convertDocument(infos, doc)
+	if err != nil {
+		return nil, conversionError(err)
+	}
+	if typesSidecar {
+		types, err := documentTypeTree(doc.Nodes)
+		if err == nil && len(types) > 0 {
+			err = setMetaKey(converted, "types", types)
+		}
+		if err != nil {
+			return nil, conversionError(err)
+		}
+	}
+	result := postProcess(converted)
+
+	if rootArray {
+		array, err := rootArrayValue(doc, result)
+		if err != nil {
+			return nil, conversionError(err)
+		}
+		return array, nil
+	}
+	if unwrap {
+		value, err := unwrapRoot(doc, result)
+		if err != nil {
+			return nil, conversionError(err)
+		}
+		return value, nil
+	}
+	return result, nil
+}
+
+// unwrapRoot returns the value of the document's single top-level node. With -emit-root-type,
+// object values also record the node's name and type annotation under metadata keys.
+func unwrapRoot(doc *document.Document, result map[string]interface{}) (interface{}, error) {
+	if len(result) != 1 {
+		return nil, fmt.Errorf("-unwrap requires a single top-level node, found %d", len(result))
+	}
+
+	for name, value := range result {
+		if !emitRootType {
+			return value, nil
+		}
+
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			warnf("cannot record the name of unwrapped node %q: its value is not an object", name)
+			return value, nil
+		}
+		if err := setMetaKey(obj, "root", name); err != nil {
+			return nil, err
+		}
+		for _, node := range doc.Nodes {
+			if nodeKey(node) == name && node.Type != "" {
+				if err := setMetaKey(obj, "type", string(node.Type)); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		return obj, nil
+	}
+
+	return nil, nil
+}
+
+// documentTypeTree builds the -types-sidecar tree for the top-level nodes, following
+// convertDocument in moving the -schema-node under the "schema" metadata key
+func documentTypeTree(nodes []*document.Node) (map[string]interface{}, error) {
+	var schemaNodes []*document.Node
+	if schemaNodeName != "" {
+		nodes, schemaNodes = splitSchemaNodes(nodes)
+	}
+	tree, err := nodeTypeTree(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemaNodes) == 1 {
+		types, err := nodeTypes(schemaNodes[0])
+		if err == nil && types != nil {
+			err = setMetaKey(tree, "schema", types)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// nodeTypeTree mirrors the converted structure of nodes, keeping only type annotations: a typed
+// node without typed descendants maps to its type, a node with typed descendants to an object
+// of them (its own type under the "type" metadata key), and grouped nodes to an array with
+// null for untyped elements. Untyped subtrees are omitted.
+func nodeTypeTree(nodes []*document.Node) (map[string]interface{}, error) {
+	groups := make(map[string][]*document.Node)
+	var order []string
+	for _, node := range nodes {
+		key := nodeKey(node)
+		if key == defaultsNodeName {
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], node)
+	}
+
+	tree := make(map[string]interface{})
+	for _, key := range order {
+		group := groups[key]
+		if noGroup {
+			// Only the last node is converted, so only its types are kept
+			group = group[len(group)-1:]
+		}
+		if len(group) == 1 {
+			types, err := nodeTypes(group[0])
+			if err != nil {
+				return nil, err
+			}
+			if types != nil {
+				tree[key] = types
+			}
+			continue
+		}
+
+		elements := make([]interface{}, len(group))
+		typed := false
+		for i, node := range group {
+			types, err := nodeTypes(node)
+			if err != nil {
+				return nil, err
+			}
+			if types != nil {
+				elements[i] = types
+				typed = true
+			}
+		}
+		if typed {
+			tree[key] = elements
+		}
+	}
+	return tree, nil
+}
+
+// nodeTypes returns the type annotations of node and its descendants, or nil if there are none
+func nodeTypes(node *document.Node) (interface{}, error) {
+	children, err := nodeTypeTree(node.Children)
+	if err != nil {
+		return nil, err
+	}
+	if len(children) == 0 {
+		if node.Type == "" {
+			return nil, nil
+		}
+		return string(node.Type), nil
+	}
+	if node.Type != "" {
+		if err := setMetaKey(children, "type", string(node.Type)); err != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+// runExplainPath prints the source of the value at path in the manifest or single input file
+func runExplainPath(filename, path string) error {
+	if flag.NArg() > 1 {
+		return fmt.Errorf("-explain-path accepts a single input file")
+	}
+
+	var data string
+	var origins []lineOrigin
+	var err error
+	if manifestFile != "" {
+		data, origins, err = manifestSource(manifestFile, newIncludeState())
+	} else {
+		data, origins, err = includeSource(filename, newIncludeState())
+	}
+	if err != nil {
+		return includeError(err)
+	}
+
+	explanation, err := explainPath(data, origins, path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", path, explanation)
+	return nil
+}
+
+// runDocs writes the documentation of the manifest or single input file to docsFile
+func runDocs(filename, docsFile string) error {
+	if flag.NArg() > 1 || inputGlob != "" {
+		return fmt.Errorf("-docs accepts a single input file")
+	}
+
+	var data string
+	var err error
+	if manifestFile != "" {
+		data, err = loadManifest(manifestFile, newIncludeState())
+	} else {
+		data, err = processIncludes(filename, newIncludeState())
+	}
+	if err != nil {
+		return includeError(err)
+	}
+
+	docs, err := docComments(data)
+	if err != nil {
+		return err
+	}
+	jsonData, err := marshalJSON(docs)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(docsFile, terminateOutput(jsonData), 0644)
+}
+
+// docComments collects the comments documenting the nodes of the include-expanded source
+// data, keyed by dotted node path. A node's documentation is the block of // lines directly
+// above it followed by the comment on its first line. Same-named nodes share a path, so their
+// distinct comments are joined; @defaults children are documented at the top level.
+func docComments(data string) (map[string]string, error) {
+	doc, err := kdl.Parse(strings.NewReader(data))
+	if err != nil {
+		return nil, parseError(err)
+	}
+	infos := matchNodeInfo(doc.Nodes, scanNodes(data))
+
+	docs := make(map[string]string)
+	collectDocComments(infos, doc.Nodes, "", docs)
+	return docs, nil
+}
+
+// sourceLocation is where an output value comes from, as written to the -line-map file
+type sourceLocation struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"col"`
+}
+
+// runLineMap writes the -line-map file for the manifest or single input file
+func runLineMap(filename, lineMapFile string) error {
+	if flag.NArg() > 1 || inputGlob != "" {
+		return fmt.Errorf("-line-map accepts a single input file")
+	}
+
+	var data string
+	var origins []lineOrigin
+	var err error
+	if manifestFile != "" {
+		data, origins, err = manifestSource(manifestFile, newIncludeState())
+	} else {
+		data, origins, err = includeSource(filename, newIncludeState())
+	}
+	if err != nil {
+		return includeError(err)
+	}
+
+	locations, err := lineMap(data, origins)
+	if err != nil {
+		return err
+	}
+	jsonData, err := marshalJSON(locations)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(lineMapFile, terminateOutput(jsonData), 0644)
+}
+
+// lineMap returns the source location of every node, argument and property of data, keyed by
+// its dotted path in the default output layout
+func lineMap(data string, origins []lineOrigin) (map[string]sourceLocation, error) {
+	doc, err := kdl.Parse(strings.NewReader(data))
+	if err != nil {
+		return nil, parseError(err)
+	}
+	infos := matchNodeInfo(doc.Nodes, scanNodes(data))
+	markNodeArgNames(infos, doc.Nodes, origins)
+
+	nodes, _ := splitDefaults(doc.Nodes)
+	locations := make(map[string]sourceLocation)
+	collectLineMap(infos, nodes, "", origins, locations)
+	return locations, nil
+}
+
+// collectLineMap adds the locations of nodes and their contents below path to locations,
+// grouping same-named nodes into indexed paths as the conversion does
+func collectLineMap(infos nodeInfos, nodes []*document.Node, path string, origins []lineOrigin, locations map[string]sourceLocation) {
+	groups := make(map[string][]*document.Node)
+	for _, node := range nodes {
+		groups[nodeKey(node)] = append(groups[nodeKey(node)], node)
+	}
+
+	for key, group := range groups {
+		if noGroup {
+			group = group[len(group)-1:]
+		}
+		for i, node := range group {
+			nodePath := joinPath(path, key)
+			if len(group) > 1 {
+				nodePath = joinPath(nodePath, strconv.Itoa(i))
+			}
+			info := infos[node]
+			if info == nil {
+				continue
+			}
+			locations[nodePath] = originLocation(origins, info.line, info.column)
+
+			// Argument-only nodes convert to their bare value, or an array of several
+			bare := bareArguments(node, len(info.argPositions))
+			for j, position := range info.argPositions {
+				switch {
+				case bare && len(info.argPositions) == 1:
+				case bare:
+					locations[joinPath(nodePath, strconv.Itoa(j))] = originLocation(origins, position.line, position.column)
+				default:
+					locations[joinPath(nodePath, nodeArgName(infos, node, j+1))] = originLocation(origins, position.line, position.column)
+				}
+			}
+			for name, position := range info.propPositions {
+				locations[joinPath(nodePath, name)] = originLocation(origins, position.line, position.column)
+			}
+			collectLineMap(infos, node.Children, nodePath, origins, locations)
+		}
+	}
+}
+
+// originLocation converts a line and column of include-expanded text to its original file
+func originLocation(origins []lineOrigin, line, column int) sourceLocation {
+	if line-1 < len(origins) {
+		origin := origins[line-1]
+		return sourceLocation{File: displayPath(origin.File), Line: origin.Line, Column: column}
+	}
+	return sourceLocation{Line: line, Column: column}
+}
+
+// nodeDoc returns the comment lines above node followed by the comment on its first line
+func nodeDoc(infos nodeInfos, node *document.Node) string {
+	info := infos[node]
+	if info == nil {
+		return ""
+	}
+	var lines []string
+	if info.doc != "" {
+		lines = append(lines, info.doc)
+	}
+	if info.comment != "" {
+		lines = append(lines, info.comment)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// collectDocComments adds the documentation of nodes and their descendants to docs
+func collectDocComments(infos nodeInfos, nodes []*document.Node, prefix string, docs map[string]string) {
+	for _, node := range nodes {
+		if prefix == "" && node.Name.NodeNameString() == defaultsNodeName {
+			collectDocComments(infos, node.Children, prefix, docs)
+			continue
+		}
+
+		path := prefix + nodeKey(node)
+		if text := nodeDoc(infos, node); text != "" {
+			switch existing, ok := docs[path]; {
+			case !ok:
+				docs[path] = text
+			case !strings.Contains("\n"+existing+"\n", "\n"+text+"\n"):
+				docs[path] = existing + "\n" + text
+			}
+		}
+		collectDocComments(infos, node.Children, path+".", docs)
+	}
+}
+
+// runGraph writes the node tree of the manifest or single input file as DOT
+func runGraph(filename string) error {
+	if flag.NArg() > 1 {
+		return fmt.Errorf("-format dot accepts a single input file")
+	}
+
+	var data string
+	var err error
+	if manifestFile != "" {
+		data, err = loadManifest(manifestFile, newIncludeState())
+	} else {
+		data, err = processIncludes(filename, newIncludeState())
+	}
+	if err != nil {
+		return includeError(err)
+	}
+
+	graph, err := nodeGraph(data)
+	if err != nil {
+		return err
+	}
+	if err := writeOutput([]byte(graph)); err != nil {
+		return fmt.Errorf("writing output: %v", err)
+	}
+	return nil
+}
+
+// nodeGraph renders the node tree of data as a Graphviz digraph: one vertex per node,
+// labeled with its name, and an edge from each node to each of its children
+func nodeGraph(data string) (string, error) {
+	doc, err := kdl.Parse(strings.NewReader(data))
+	if err != nil {
+		return "", parseError(err)
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph kdl {\n")
+	id := 0
+	var walk func(nodes []*document.Node, parent string)
+	walk = func(nodes []*document.Node, parent string) {
+		for _, node := range nodes {
+			id++
+			vertex := fmt.Sprintf("n%d", id)
+			fmt.Fprintf(&b, "    %s [label=%s];\n", vertex, dotQuote(nodeKey(node)))
+			if parent != "" {
+				fmt.Fprintf(&b, "    %s -> %s;\n", parent, vertex)
+			}
+			walk(node.Children, vertex)
+		}
+	}
+	walk(doc.Nodes, "")
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+// dotQuote quotes s as a DOT string
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// explainPath describes the node, argument or property of the include-expanded source data
+// that produces the output value at a dotted path, with its file and line from origins.
+// Paths follow the default output structure: numeric segments index grouped nodes or the
+// arguments of argument-only nodes.
+func explainPath(data string, origins []lineOrigin, path string) (string, error) {
+	doc, err := kdl.Parse(strings.NewReader(data))
+	if err != nil {
+		return "", parseError(err)
+	}
+	infos := matchNodeInfo(doc.Nodes, scanNodes(data))
+	markNodeArgNames(infos, doc.Nodes, origins)
+
+	segments := strings.Split(path, ".")
+	regular, defaults := splitDefaults(doc.Nodes)
+	if explanation, ok := explainInList(infos, regular, segments, origins); ok {
+		return explanation, nil
+	}
+
+	// Values missing from the document may come from a @defaults block
+	for _, block := range defaults {
+		if explanation, ok := explainInNode(infos, block, segments, origins); ok {
+			return explanation + " (from " + defaultsNodeName + " at " + nodeLocation(infos, block, origins) + ")", nil
+		}
+	}
+	return "", fmt.Errorf("no value at this path")
+}
+
+// explainInList resolves segments starting with a node name among nodes
+func explainInList(infos nodeInfos, nodes []*document.Node, segments []string, origins []lineOrigin) (string, bool) {
+	var group []*document.Node
+	for _, node := range nodes {
+		if nodeKey(node) == segments[0] {
+			group = append(group, node)
+		}
+	}
+	if len(group) == 0 {
+		return "", false
+	}
+
+	rest := segments[1:]
+	node := group[0]
+	if len(group) > 1 {
+		// Grouped nodes are an array, indexed by the next segment
+		if len(rest) == 0 {
+			return fmt.Sprintf("%d nodes %q, first at %s", len(group), segments[0], nodeLocation(infos, node, origins)), true
+		}
+		index, err := strconv.Atoi(rest[0])
+		if err != nil || index < 0 || index >= len(group) {
+			return "", false
+		}
+		node = group[index]
+		rest = rest[1:]
+	}
+
+	if len(rest) == 0 {
+		return fmt.Sprintf("node %q at %s", segments[0], nodeLocation(infos, node, origins)), true
+	}
+	return explainInNode(infos, node, rest, origins)
+}
+
+// explainInNode resolves segments naming a property, argument or child of node
+func explainInNode(infos nodeInfos, node *document.Node, segments []string, origins []lineOrigin) (string, bool) {
+	name := node.Name.NodeNameString()
+	location := nodeLocation(infos, node, origins)
+
+	if len(segments) == 1 {
+		if value, ok := node.Properties[segments[0]]; ok {
+			return fmt.Sprintf("property %s=%s of node %q at %s", segments[0], value.String(), name, location), true
+		}
+		for i, arg := range node.Arguments {
+			if nodeArgName(infos, node, i+1) == segments[0] {
+				return fmt.Sprintf("argument %d (%s) of node %q at %s", i+1, arg.String(), name, location), true
+			}
+		}
+		// Argument-only nodes convert to an array of their arguments
+		if index, err := strconv.Atoi(segments[0]); err == nil && len(node.Properties) == 0 && len(node.Children) == 0 {
+			if index >= 0 && index < len(node.Arguments) && len(node.Arguments) > 1 {
+				return fmt.Sprintf("argument %d (%s) of node %q at %s", index+1, node.Arguments[index].String(), name, location), true
+			}
+		}
+	}
+
+	return explainInList(infos, node.Children, segments, origins)
+}
+
+// nodeLocation formats where node appears in the original files
+func nodeLocation(infos nodeInfos, node *document.Node, origins []lineOrigin) string {
+	info := infos[node]
+	if info == nil {
+		return "unknown location"
+	}
+	if info.line-1 < len(origins) {
+		return origins[info.line-1].String()
+	}
+	return fmt.Sprintf("line %d", info.line)
+}
+
+// markNodeSources records the file each top-level node starts in
+func markNodeSources(infos nodeInfos, nodes []*document.Node, origins []lineOrigin) {
+	for _, node := range nodes {
+		if info := infos[node]; info != nil && info.line-1 < len(origins) {
+			info.source = displayPath(origins[info.line-1].File)
+		}
+	}
+}
+
+// markNodeLocations records the file and line of nodes and their descendants for error messages
+func markNodeLocations(infos nodeInfos, nodes []*document.Node, origins []lineOrigin) {
+	for _, node := range nodes {
+		if info := infos[node]; info != nil {
+			info.location = nodeLocation(infos, node, origins)
+		}
+		markNodeLocations(infos, node.Children, origins)
+	}
+}
+
+// hasArgNameScopes reports whether any line of origins is in the scope of an @argnames directive
+func hasArgNameScopes(origins []lineOrigin) bool {
+	for _, origin := range origins {
+		if origin.ArgNames != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// markNodeArgNames records the @argnames in scope where each node starts, at every depth
+func markNodeArgNames(infos nodeInfos, nodes []*document.Node, origins []lineOrigin) {
+	for _, node := range nodes {
+		if info := infos[node]; info != nil && info.line-1 < len(origins) {
+			info.argNames = origins[info.line-1].ArgNames
+		}
+		markNodeArgNames(infos, node.Children, origins)
+	}
+}
+
+// withNodeSource adds the -with-source key to value if node has a recorded file and
+// converted to an object
+func withNodeSource(infos nodeInfos, node *document.Node, value interface{}) (interface{}, error) {
+	info := infos[node]
+	if info == nil || info.source == "" {
+		return value, nil
+	}
+	if obj, ok := value.(map[string]interface{}); ok {
+		if err := setMetaKey(obj, "source", info.source); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// runStream streams the manifest or single input file to -output or stdout
+func runStream(filename string) error {
+	if flag.NArg() > 1 {
+		return fmt.Errorf("-stream accepts a single input file")
+	}
+
+	var data string
+	var origins []lineOrigin
+	var err error
+	if manifestFile != "" {
+		data, origins, err = manifestSource(manifestFile, newIncludeState())
+	} else {
+		data, origins, err = includeSource(filename, newIncludeState())
+	}
+	if err != nil {
+		return includeError(err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if outputFile != "" {
+		file, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("writing output: %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	bw := bufio.NewWriter(w)
+	if err := streamSource(data, origins, bw); err != nil {
+		bw.Flush()
+		return err
+	}
+	return bw.Flush()
+}
+
+// streamSource converts the top-level nodes of data one at a time, writing each as a single
+// line {"name": value}. origins gives the file and line of every line of data, as for
+// convertSourceOrigins, and may be nil. The source is held in memory but only one node's
+// converted tree is, so nodes with the same name are not grouped and @defaults blocks are not
+// supported.
+func streamSource(data string, origins []lineOrigin, w io.Writer) error {
+	data = strings.TrimPrefix(data, "\ufeff")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(!noEscapeHTML)
+
+	for _, info := range scanNodes(data) {
+		location := fmt.Sprintf("line %d", info.line)
+		var chunkOrigins []lineOrigin
+		if info.line-1 < len(origins) {
+			location = origins[info.line-1].String()
+			chunkOrigins = origins[info.line-1:]
+		}
+
+		chunk := data[info.start:info.end]
+		doc, err := kdl.Parse(strings.NewReader(chunk))
+		if err != nil {
+			return fmt.Errorf("node at %s: %w", location, parseError(err))
+		}
+		for _, node := range doc.Nodes {
+			if node.Name.NodeNameString() == defaultsNodeName {
+				return fmt.Errorf("node at %s: %s is not supported with -stream", location, defaultsNodeName)
+			}
+		}
+
+		result, err := convertParsedSource(doc, chunk, chunkOrigins)
+		if err != nil {
+			return fmt.Errorf("node at %s: %w", location, err)
+		}
+
+		// Nodes removed entirely, e.g. by -omit-empty, produce no line
+		obj, ok := result.(map[string]interface{})
+		if !ok && result != nil {
+			return fmt.Errorf("node at %s: converted to %T instead of an object", location, result)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		if err := encoder.Encode(obj); err != nil {
+			return fmt.Errorf("node at %s: %v", location, err)
+		}
+	}
+	return nil
+}
+
+// rootArrayValue returns the document as a bare array of the values of its single top-level node name
+func rootArrayValue(doc *document.Document, result map[string]interface{}) ([]interface{}, error) {
+	if len(result) != 1 {
+		keys := make([]string, 0, len(result))
+		for key := range result {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("-root-array requires all top-level nodes to share one name, found: %s", strings.Join(keys, ", "))
+	}
+
+	for name, value := range result {
+		count := 0
+		for _, node := range doc.Nodes {
+			if nodeKey(node) == name {
+				count++
+			}
+		}
+
+		// Repeated nodes are already grouped into an array
+		if array, ok := value.([]interface{}); ok && count > 1 {
+			return array, nil
+		}
+		return []interface{}{value}, nil
+	}
+
+	return []interface{}{}, nil
+}
+
+// convertFiles converts each file separately and returns the results keyed by filename.
+// Without -continue-on-error it stops at the first failure.
+func convertFiles(filenames []string) (map[string]interface{}, []error) {
+	results := make(map[string]interface{})
+	var errs []error
+
+	for _, filename := range filenames {
+		result, err := convertFile(filename)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("in %s: %w", filename, err))
+			if !continueOnError {
+				break
+			}
+			continue
+		}
+		results[filename] = result
+	}
+
+	return results, errs
+}
+
+// globInputs returns the files matching the -input-glob pattern, failing when there are none
+func globInputs(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -input-glob pattern %q: %v", pattern, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match -input-glob %q", pattern)
+	}
+	return matches, nil
+}
+
+// convertGlob converts every file matching pattern on its own, writing each result to
+// dir/<name>.json, where name is the file name without its extension. Up to -parallel files
+// are converted at once. Each file's outcome is reported to report, in file order once all
+// are done; it returns the number of files that failed.
+func convertGlob(pattern, dir string, report io.Writer) (int, error) {
+	if dir == "" {
+		return 0, fmt.Errorf("-input-glob requires -split-dir for the output files")
+	}
+	matches, err := globInputs(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files with the same name in different directories would overwrite each other
+	names := make([]string, len(matches))
+	sources := make(map[string]string, len(matches))
+	for i, match := range matches {
+		names[i] = strings.TrimSuffix(filepath.Base(match), filepath.Ext(match)) + ".json"
+		if other, ok := sources[names[i]]; ok {
+			return 0, fmt.Errorf("%s and %s would both be written to %s", other, match, names[i])
+		}
+		sources[names[i]] = match
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	errs := make([]error, len(matches))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelJobs && w < len(matches); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = convertGlobFile(matches[i], filepath.Join(dir, names[i]))
+			}
+		}()
+	}
+	for i := range matches {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	failures := 0
+	for i, match := range matches {
+		if errs[i] != nil {
+			fmt.Fprintf(report, "FAIL %s: %v\n", match, errs[i])
+			failures++
+			continue
+		}
+		fmt.Fprintf(report, "ok   %s -> %s\n", match, filepath.Join(dir, names[i]))
+	}
+	return failures, nil
+}
+
+// convertGlobFile converts one -input-glob file and writes its JSON to output
+func convertGlobFile(filename, output string) error {
+	result, err := convertFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := stripKeyPrefix(result, stripPrefix, ""); err != nil {
+		return err
+	}
+	if err := renameKeys(result, renames); err != nil {
+		return err
+	}
+	if emitDefaults {
+		applySchemaDefaults(result, outputSchema)
+	}
+	if result, err = applyTransform(result); err != nil {
+		return err
+	}
+	if missing := missingPaths(result, requiredPaths); len(missing) > 0 {
+		return fmt.Errorf("missing required keys: %s", strings.Join(missing, ", "))
+	}
+	if err := checkEmptyResult(result); err != nil {
+		return err
+	}
+
+	jsonData, err := encodeJSON(result)
+	if err != nil {
+		return conversionError(err)
+	}
+	jsonData = terminateOutput(jsonData)
+	if err := checkOutputSize(int64(len(jsonData))); err != nil {
+		return err
+	}
+	return os.WriteFile(output, jsonData, 0644)
+}
+
+// postProcess applies the output options that reshape the converted document
+func postProcess(result map[string]interface{}) map[string]interface{} {
+	postProcessValue(result)
+	return result
+}
+
+// postProcessValue applies the same options as postProcess to any converted value
+func postProcessValue(v interface{}) interface{} {
+	if len(redactKeys) > 0 {
+		redactValues(v)
+	}
+	if omitEmpty {
+		pruneEmpty(v)
+	}
+	if floatPrecision > 0 {
+		v = roundFloats(v, floatPrecision)
+	}
+	return v
+}
+
+// redactedValue replaces the values of keys matched by -redact
+const redactedValue = "***"
+
+// redactValues replaces the value of every object member whose key matches a -redact pattern,
+// recursing into nested objects and arrays
+func redactValues(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for key, value := range x {
+			if matchesKey(redactKeys, key) {
+				x[key] = redactedValue
+			} else {
+				redactValues(value)
+			}
+		}
+	case []interface{}:
+		for _, item := range x {
+			redactValues(item)
+		}
+	}
+}
+
+// matchesKey reports whether key matches any of the glob patterns given to a flag such as -redact
+func matchesKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneEmpty removes empty members from objects, recursing into nested objects and arrays.
+// Array elements are pruned recursively but never removed, so positions are preserved.
+// It reports whether v itself is empty after pruning.
+func pruneEmpty(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		for key, value := range x {
+			if pruneEmpty(value) {
+				delete(x, key)
+			}
+		}
+		return len(x) == 0
+	case []interface{}:
+		for _, item := range x {
+			pruneEmpty(item)
+		}
+		return len(x) == 0 && !keepEmptyArrays
+	default:
+		return false
+	}
+}
+
+// lookupPath returns the value at a dotted path such as "server.port". Numeric segments
+// index into arrays, so "item.0.name" is the name of the first item node.
+func lookupPath(v interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			value, ok := x[segment]
+			if !ok {
+				return nil, false
+			}
+			v = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(x) {
+				return nil, false
+			}
+			v = x[index]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// applyArgCountMappings parses "NAME=MIN..MAX" constraints into argCounts. A single number
+// requires exactly that many arguments, and either bound of a range may be left out.
+func applyArgCountMappings(mappings []string) error {
+	for _, mapping := range mappings {
+		name, spec, ok := strings.Cut(mapping, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid -args %q (expected NAME=MIN..MAX)", mapping)
+		}
+
+		minText, maxText, isRange := strings.Cut(spec, "..")
+		if !isRange {
+			maxText = minText
+		}
+		r := argCountRange{min: 0, max: -1}
+		var err error
+		if minText != "" {
+			r.min, err = strconv.Atoi(minText)
+		}
+		if err == nil && maxText != "" {
+			r.max, err = strconv.Atoi(maxText)
+		}
+		if err != nil || spec == "" || spec == ".." || r.min < 0 || (r.max >= 0 && r.max < r.min) {
+			return fmt.Errorf("invalid -args %q (expected NAME=MIN..MAX with 0 <= MIN <= MAX)", mapping)
+		}
+		argCounts[name] = r
+	}
+	return nil
+}
+
+// String describes the range for error messages
+func (r argCountRange) String() string {
+	switch {
+	case r.min == r.max:
+		return strconv.Itoa(r.min)
+	case r.max < 0:
+		return fmt.Sprintf("at least %d", r.min)
+	default:
+		return fmt.Sprintf("%d to %d", r.min, r.max)
+	}
+}
+
+// checkArgCount enforces the -args constraint for node's name, if any
+func checkArgCount(infos nodeInfos, node *document.Node) error {
+	r, ok := argCounts[nodeKey(node)]
+	if !ok {
+		return nil
+	}
+	count := len(node.Arguments)
+	if count >= r.min && (r.max < 0 || count <= r.max) {
+		return nil
+	}
+
+	location := ""
+	if info := infos[node]; info != nil && info.location != "" {
+		location = " at " + info.location
+	}
+	return fmt.Errorf("%d arguments%s, expected %s", count, location, r)
+}
+
+// defaultConfigFiles are looked for in the working directory when -config isn't given
+var defaultConfigFiles = []string{".kdlc.kdl", ".kdlc.json"}
+
+// configSetting is a flag and the values a config file gives it, one per repetition
+type configSetting struct {
+	name   string
+	values []string
+}
+
+// applyConfig sets the flags of fs from -config, or the first default config file that exists,
+// skipping flags that were set on the command line
+func applyConfig(fs *flag.FlagSet) error {
+	path := configFile
+	if path == "" {
+		for _, name := range defaultConfigFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+		if path == "" {
+			return nil
+		}
+	}
+
+	settings, err := readConfig(path)
+	if err != nil {
+		return fmt.Errorf("reading config %s: %v", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, setting := range settings {
+		f := fs.Lookup(setting.name)
+		if f == nil || setting.name == "config" {
+			return fmt.Errorf("config %s: unknown flag %q", path, setting.name)
+		}
+		if explicit[setting.name] {
+			continue
+		}
+		values := setting.values
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() && len(values) == 0 {
+			values = []string{"true"}
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("config %s: flag %q needs a value", path, setting.name)
+		}
+		for _, value := range values {
+			if err := fs.Set(setting.name, value); err != nil {
+				return fmt.Errorf("config %s: invalid value %q for flag -%s: %v", path, value, setting.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readConfig reads the flag settings in a config file. In KDL, each node names a flag and its
+// arguments are the values, given several times for repeatable flags; a bool flag without
+// arguments is set to true. In JSON, each key names a flag, and an array gives several values.
+func readConfig(path string) ([]configSetting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []configSetting
+	if strings.HasSuffix(path, ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("parsing JSON: %v", err)
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			items, ok := obj[name].([]interface{})
+			if !ok {
+				items = []interface{}{obj[name]}
+			}
+			setting := configSetting{name: name}
+			for _, item := range items {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}, nil:
+					return nil, fmt.Errorf("flag %q: values must be strings, numbers or booleans", name)
+				}
+				setting.values = append(setting.values, fmt.Sprint(item))
+			}
+			settings = append(settings, setting)
+		}
+		return settings, nil
+	}
+
+	doc, err := kdl.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, parseError(err)
+	}
+	for _, node := range doc.Nodes {
+		name := node.Name.ValueString()
+		if len(node.Properties) > 0 || len(node.Children) > 0 {
+			return nil, fmt.Errorf("flag %q: only arguments are supported", name)
+		}
+		setting := configSetting{name: name}
+		for _, arg := range node.Arguments {
+			if s, ok := arg.Value.(string); ok {
+				setting.values = append(setting.values, s)
+			} else if arg.Value == nil {
+				return nil, fmt.Errorf("flag %q: values must be strings, numbers or booleans", name)
+			} else {
+				setting.values = append(setting.values, fmt.Sprint(arg.Value))
+			}
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+// applyRenameMappings parses "FROM=TO" renames into renames
+func applyRenameMappings(mappings []string) error {
+	for _, mapping := range mappings {
+		from, to, ok := strings.Cut(mapping, "=")
+		if !ok || from == "" || to == "" || strings.Contains(to, ".") {
+			return fmt.Errorf("invalid -rename %q (expected FROM=TO with FROM a dotted path and TO a key name)", mapping)
+		}
+		renames = append(renames, keyRename{from: from, to: to})
+	}
+	return nil
+}
+
+// stripKeyPrefix removes prefix from every object key in v that starts with it, at any depth.
+// A key equal to the prefix is kept, and stripping that would give two keys of one object the
+// same name is an error naming both keys.
+func stripKeyPrefix(v interface{}, prefix, path string) error {
+	if prefix == "" {
+		return nil
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		stripped := make(map[string]interface{}, len(x))
+		sources := make(map[string]string, len(x))
+		for _, key := range keys {
+			if err := stripKeyPrefix(x[key], prefix, joinPath(path, key)); err != nil {
+				return err
+			}
+			name := key
+			if len(key) > len(prefix) && strings.HasPrefix(key, prefix) {
+				name = key[len(prefix):]
+			}
+			if other, exists := sources[name]; exists {
+				return fmt.Errorf("cannot strip prefix %q: %s and %s would both become %s", prefix, joinPath(path, other), joinPath(path, key), joinPath(path, name))
+			}
+			sources[name] = key
+			stripped[name] = x[key]
+		}
+		for key := range x {
+			delete(x, key)
+		}
+		for key, value := range stripped {
+			x[key] = value
+		}
+	case []interface{}:
+		for i, item := range x {
+			if err := stripKeyPrefix(item, prefix, joinPath(path, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyKeyByMappings parses "NODE=PROP" mappings into keyByProps
+func applyKeyByMappings(mappings []string) error {
+	for _, mapping := range mappings {
+		node, prop, ok := strings.Cut(mapping, "=")
+		if !ok || node == "" || prop == "" {
+			return fmt.Errorf("invalid -key-by %q (expected NODE=PROP)", mapping)
+		}
+		keyByProps[node] = prop
+	}
+	return nil
+}
+
+// applyAliasMappings parses "FROM=TO" node name aliases into nodeAliases
+func applyAliasMappings(mappings []string) error {
+	for _, mapping := range mappings {
+		from, to, ok := strings.Cut(mapping, "=")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid -alias %q (expected FROM=TO)", mapping)
+		}
+		if caseInsensitiveNames {
+			from, to = strings.ToLower(from), strings.ToLower(to)
+		}
+		if previous, ok := nodeAliases[from]; ok && previous != to {
+			return fmt.Errorf("node name %q is aliased to both %q and %q", from, previous, to)
+		}
+		nodeAliases[from] = to
+	}
+	return nil
+}
+
+// renameKeys applies renames to result in order. Each source path must exist, and the new
+// name must not already be used by a sibling key.
+func renameKeys(result interface{}, renames []keyRename) error {
+	for _, rename := range renames {
+		parent, key := result, rename.from
+		if i := strings.LastIndex(rename.from, "."); i >= 0 {
+			var ok bool
+			parent, ok = lookupPath(result, rename.from[:i])
+			if !ok {
+				return fmt.Errorf("cannot rename %s: no such key", rename.from)
+			}
+			key = rename.from[i+1:]
+		}
+
+		obj, ok := parent.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot rename %s: its parent is not an object", rename.from)
+		}
+		value, ok := obj[key]
+		if !ok {
+			return fmt.Errorf("cannot rename %s: no such key", rename.from)
+		}
+		if key == rename.to {
+			continue
+		}
+		if _, exists := obj[rename.to]; exists {
+			return fmt.Errorf("cannot rename %s to %s: the key already exists", rename.from, rename.to)
+		}
+		delete(obj, key)
+		obj[rename.to] = value
+	}
+	return nil
+}
+
+// missingPaths returns the paths that are not present in result, in the order given
+func missingPaths(result interface{}, paths []string) []string {
+	var missing []string
+	for _, path := range paths {
+		if _, ok := lookupPath(result, path); !ok {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+// loadSchema reads the JSON Schema in filename, which must be an object
+func loadSchema(filename string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	// Keep default numbers exactly as written
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var schema interface{}
+	if err := decoder.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %v", err)
+	}
+	obj, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema is not a JSON object")
+	}
+	return obj, nil
+}
+
+// applySchemaDefaults adds a copy of the "default" of every property in schema's "properties"
+// that v lacks, recursing into the properties v has and into array elements through "items".
+// Properties present in v, even with a null value, are left alone.
+func applySchemaDefaults(v interface{}, schema map[string]interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range properties {
+			propertySchema, ok := property.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if value, exists := x[name]; exists {
+				applySchemaDefaults(value, propertySchema)
+			} else if def, ok := propertySchema["default"]; ok {
+				x[name] = copyValue(def)
+			}
+		}
+	case []interface{}:
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, item := range x {
+			applySchemaDefaults(item, items)
+		}
+	}
+}
+
+// copyValue returns a deep copy of a decoded JSON value
+func copyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(x))
+		for key, value := range x {
+			obj[key] = copyValue(value)
+		}
+		return obj
+	case []interface{}:
+		array := make([]interface{}, len(x))
+		for i, value := range x {
+			array[i] = copyValue(value)
+		}
+		return array
+	default:
+		return v
+	}
+}
+
+// filterNodes returns the nodes at depth (0 for top-level nodes) that satisfy the -node-filter
+// predicate, filtering their children in turn. A rejected node is dropped with its children.
+func filterNodes(nodes []*document.Node, depth int) ([]*document.Node, error) {
+	var kept []*document.Node
+	for _, node := range nodes {
+		args := make([]interface{}, len(node.Arguments))
+		for i, arg := range node.Arguments {
+			args[i] = convertValue(arg)
+		}
+		props := make(map[string]interface{}, len(node.Properties))
+		for name, value := range node.Properties {
+			props[name] = convertValue(value)
+		}
+		env := map[string]interface{}{
+			"name":     nodeKey(node),
+			"args":     args,
+			"props":    props,
+			"children": len(node.Children),
+			"depth":    depth,
+		}
+
+		output, err := expr.Run(nodeFilterProgram, env)
+		if err != nil {
+			return nil, fmt.Errorf("-node-filter: node %s: %v", nodeKey(node), err)
+		}
+		if keep, _ := output.(bool); !keep {
+			continue
+		}
+		if node.Children, err = filterNodes(node.Children, depth+1); err != nil {
+			return nil, err
+		}
+		kept = append(kept, node)
+	}
+	return kept, nil
+}
+
+// applyTransform evaluates the -transform expression on result and returns its value, reduced
+// to the JSON data model. Without -transform, result is returned as is.
+func applyTransform(result interface{}) (interface{}, error) {
+	if transformProgram == nil {
+		return result, nil
+	}
+	output, err := expr.Run(transformProgram, expressionEnv(result))
+	if err != nil {
+		return nil, fmt.Errorf("-transform: %v", err)
+	}
+
+	// Expression values may be ints, typed slices and so on, so round-trip them through JSON
+	data, err := json.Marshal(output)
+	if err != nil {
+		return nil, fmt.Errorf("-transform: the result is not JSON data: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var transformed interface{}
+	if err := decoder.Decode(&transformed); err != nil {
+		return nil, fmt.Errorf("-transform: %v", err)
+	}
+	return transformed, nil
+}
+
+// expressionEnv binds a value for an expression: the whole value as doc and, for an object,
+// each of its keys as a variable. -var variables and, with -null-input, the environment as env
+// are bound as well, unless a key of the value has the same name.
+func expressionEnv(v interface{}) map[string]interface{} {
+	env := make(map[string]interface{})
+	if nullInput {
+		environment := make(map[string]interface{})
+		for _, entry := range os.Environ() {
+			if name, value, ok := strings.Cut(entry, "="); ok {
+				environment[name] = value
+			}
+		}
+		env["env"] = environment
+	}
+	for name, value := range transformVars {
+		env[name] = value
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		for key, value := range obj {
+			env[key] = value
+		}
+	}
+	env["doc"] = v
+	return env
+}
+
+// checkEmptyResult fails for a result that is null, {} or [] unless -empty-ok is set
+func checkEmptyResult(result interface{}) error {
+	if emptyOK {
+		return nil
+	}
+	empty := false
+	switch x := result.(type) {
+	case nil:
+		empty = true
+	case map[string]interface{}:
+		empty = len(x) == 0
+	case []interface{}:
+		empty = len(x) == 0
+	}
+	if empty {
+		return fmt.Errorf("the result is empty (use -empty-ok to allow this)")
+	}
+	return nil
+}
+
+// mergeIntoFile loads the JSON document in filename and deep-merges result on top of it.
+func mergeIntoFile(filename string, result interface{}) (interface{}, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	// Keep existing numbers exactly as written
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var existing interface{}
+	if err := decoder.Decode(&existing); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %v", err)
+	}
+
+	return mergeValues(existing, result), nil
+}
+
+// mergeValues deep-merges src into dst. Objects are merged key by key, arrays are replaced or
+// appended according to mergeArrays, and any other conflict is resolved in favor of src.
+func mergeValues(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		d, ok := dst.(map[string]interface{})
+		if !ok {
+			return src
+		}
+		for key, value := range s {
+			if existing, found := d[key]; found {
+				d[key] = mergeValues(existing, value)
+			} else {
+				d[key] = value
+			}
+		}
+		return d
+	case []interface{}:
+		if d, ok := dst.([]interface{}); ok && mergeArrays == "append" {
+			return append(d, s...)
+		}
+		return src
+	default:
+		return src
+	}
+}
+
+// schemaNode accumulates what has been observed about the values at one position of a document.
+type schemaNode struct {
+	types      map[string]bool
+	properties map[string]*schemaNode
+	required   map[string]bool // keys present in every object seen at this position
+	items      *schemaNode
+	objects    int
+}
+
+// inferSchema returns a JSON Schema describing v. Object keys are required when they appear in
+// every object seen at that position, e.g. in every node of a group.
+func inferSchema(v interface{}) map[string]interface{} {
+	node := &schemaNode{}
+	node.observe(v)
+	schema := node.schema()
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	return schema
+}
+
+// observe records the type and structure of v.
+func (n *schemaNode) observe(v interface{}) {
+	if n.types == nil {
+		n.types = make(map[string]bool)
+	}
+	n.types[schemaType(v)] = true
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if n.properties == nil {
+			n.properties = make(map[string]*schemaNode)
+		}
+		present := make(map[string]bool, len(x))
+		for key, value := range x {
+			child, ok := n.properties[key]
+			if !ok {
+				child = &schemaNode{}
+				n.properties[key] = child
+			}
+			child.observe(value)
+			present[key] = true
+		}
+		// A key is required only if every object at this position has it
+		if n.objects == 0 {
+			n.required = present
+		} else {
+			for key := range n.required {
+				if !present[key] {
+					delete(n.required, key)
+				}
+			}
+		}
+		n.objects++
+	case []interface{}:
+		for _, elem := range x {
+			if n.items == nil {
+				n.items = &schemaNode{}
+			}
+			n.items.observe(elem)
+		}
+	}
+}
+
+// schema renders the accumulated observations as a JSON Schema object.
+func (n *schemaNode) schema() map[string]interface{} {
+	// An integer position that also held fractional numbers is a number
+	if n.types["number"] {
+		delete(n.types, "integer")
+	}
+	types := make([]string, 0, len(n.types))
+	for t := range n.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	schema := make(map[string]interface{})
+	if len(types) == 1 {
+		schema["type"] = types[0]
+	} else {
+		schema["type"] = types
+	}
+
+	if n.properties != nil {
+		properties := make(map[string]interface{}, len(n.properties))
+		for key, child := range n.properties {
+			properties[key] = child.schema()
+		}
+		schema["properties"] = properties
+
+		required := make([]string, 0, len(n.required))
+		for key := range n.required {
+			required = append(required, key)
+		}
+		sort.Strings(required)
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+	}
+
+	if n.items != nil {
+		schema["items"] = n.items.schema()
+	}
+
+	return schema
+}
+
+// schemaType returns the JSON Schema type name for a converted value.
+func schemaType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case int, int64:
+		return "integer"
+	case float64:
+		return "number"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		return "string"
+	}
+}
+
+// roundFloats rounds every float64 inside v to the given number of significant digits.
+// Formatting goes through strconv, so the result never depends on the locale.
+func roundFloats(v interface{}, precision int) interface{} {
+	switch x := v.(type) {
+	case float64:
+		rounded, err := strconv.ParseFloat(strconv.FormatFloat(x, 'g', precision, 64), 64)
+		if err != nil {
+			return x
+		}
+		return rounded
+	case map[string]interface{}:
+		for key, value := range x {
+			x[key] = roundFloats(value, precision)
+		}
+	case []interface{}:
+		for i, value := range x {
+			x[i] = roundFloats(value, precision)
+		}
+	}
+	return v
+}
+
+// splitFile is the serialized output for one top-level entry when splitting
+type splitFile struct {
+	name string // file name, <node>.json
+	data []byte
+}
+
+// splitFiles serializes each top-level entry of result as <name>.json, sorted by name.
+// Grouped duplicate nodes are serialized as a single file containing the array.
+func splitFiles(result map[string]interface{}) ([]splitFile, error) {
+	names := make([]string, 0, len(result))
+	for name := range result {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("cannot use node name %q as a file name", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]splitFile, 0, len(names))
+	for _, name := range names {
+		jsonData, err := marshalJSON(result[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s to JSON: %v", name, err)
+		}
+		files = append(files, splitFile{name: name + ".json", data: terminateOutput(jsonData)})
+	}
+
+	// The limit applies to the files together, checked before any is written
+	var total int64
+	for _, file := range files {
+		total += int64(len(file.data))
+	}
+	if err := checkOutputSize(total); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// writeSplitFiles writes each top-level entry of result to dir/<name>.json.
+func writeSplitFiles(dir string, result map[string]interface{}) error {
+	files, err := splitFiles(result)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, file.data, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeSplitArchive writes each top-level entry of result to <name>.json inside a zip or
+// gzipped tar archive, chosen by the extension of filename.
+func writeSplitArchive(filename string, result map[string]interface{}) error {
+	files, err := splitFiles(result)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch {
+	case strings.HasSuffix(filename, ".zip"):
+		err = writeZip(&buf, files)
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		err = writeTarGz(&buf, files)
+	default:
+		return fmt.Errorf("unsupported archive type %s (want .zip, .tar.gz or .tgz)", filename)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %v", err)
+	}
+
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	return nil
+}
+
+// writeZip writes files to w as a zip archive
+func writeZip(w io.Writer, files []splitFile) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz writes files to w as a gzipped tar archive
+func writeTarGz(w io.Writer, files []splitFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    0644,
+			Size:    int64(len(file.data)),
+			ModTime: time.Unix(0, 0),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// canonicalJSON serializes v as RFC 8785 (JCS) canonical JSON: object keys sorted by UTF-16 code units,
+// no insignificant whitespace, minimal string escaping and ECMAScript number formatting.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	// Round-trip through encoding/json so every value is reduced to the plain JSON data model
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var plain interface{}
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, plain); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCanonical writes a plain JSON value to buf in canonical form
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(x))
+	case float64:
+		number, err := formatCanonicalNumber(x)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(number)
+	case string:
+		writeCanonicalString(buf, x)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range x {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return lessUTF16(keys[i], keys[j])
+		})
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, x[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported value of type %T in canonical JSON", v)
+	}
+	return nil
+}
+
+// lessUTF16 compares two strings by their UTF-16 code units, as required by RFC 8785
+func lessUTF16(a, b string) bool {
+	ua := utf16.Encode([]rune(a))
+	ub := utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+// writeCanonicalString writes s as a JSON string, escaping only what RFC 8785 requires
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// formatCanonicalNumber formats f the way ECMAScript's Number.prototype.toString does
+func formatCanonicalNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("cannot represent %v in canonical JSON", f)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+
+	// Shortest round-trip digits and the decimal exponent, as d.ddde±x
+	mantissa, expText, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	exp, err := strconv.Atoi(expText)
+	if err != nil {
+		return "", err
+	}
+
+	// The value is 0.digits × 10^n
+	k := len(digits)
+	n := exp + 1
+
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k), nil
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:], nil
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits, nil
+	}
+
+	expSign := "+"
+	if n-1 < 0 {
+		expSign = "-"
+	}
+	expValue := strconv.Itoa(abs(n - 1))
+	if k == 1 {
+		return sign + digits + "e" + expSign + expValue, nil
+	}
+	return sign + digits[:1] + "." + digits[1:] + "e" + expSign + expValue, nil
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// ANSI escape sequences used for colorized output
+const (
+	colorReset  = "\x1b[0m"
+	colorKey    = "\x1b[34;1m"
+	colorString = "\x1b[32m"
+	colorNumber = "\x1b[36m"
+	colorBool   = "\x1b[33m"
+	colorNull   = "\x1b[90m"
+)
+
+// shouldColorize decides whether output should be colorized for the given -color mode
+func shouldColorize(mode string, terminal bool) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return terminal && os.Getenv("NO_COLOR") == "", nil
+	default:
+		return false, fmt.Errorf("invalid -color value %q (expected auto, always, or never)", mode)
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorizeJSON wraps the keys, strings, numbers, booleans and nulls of marshaled JSON in ANSI colors
+func colorizeJSON(data []byte) []byte {
+	var out []byte
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '"':
+			// Find the end of the string, skipping escaped characters
+			end := i + 1
+			for end < len(data) && data[end] != '"' {
+				if data[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+			if end > len(data) {
+				end = len(data)
+			}
+
+			// A string followed by a colon is an object key
+			color := colorString
+			next := end
+			for next < len(data) && (data[next] == ' ' || data[next] == '\n' || data[next] == '\t' || data[next] == '\r') {
+				next++
+			}
+			if next < len(data) && data[next] == ':' {
+				color = colorKey
+			}
+
+			out = append(out, color...)
+			out = append(out, data[i:end]...)
+			out = append(out, colorReset...)
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i
+			for end < len(data) && strings.IndexByte("+-0123456789.eE", data[end]) >= 0 {
+				end++
+			}
+			out = append(out, colorNumber...)
+			out = append(out, data[i:end]...)
+			out = append(out, colorReset...)
+			i = end
+		case bytes.HasPrefix(data[i:], []byte("true")):
+			out = append(out, colorBool+"true"+colorReset...)
+			i += len("true")
+		case bytes.HasPrefix(data[i:], []byte("false")):
+			out = append(out, colorBool+"false"+colorReset...)
+			i += len("false")
+		case bytes.HasPrefix(data[i:], []byte("null")):
+			out = append(out, colorNull+"null"+colorReset...)
+			i += len("null")
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+
+	return out
+}
+
+// includeState tracks the files visited while expanding @include directives
+type includeState struct {
+	active map[string]bool   // files on the current include stack
+	seen   map[string]bool   // every file included so far
+	deps   []includeDep      // files and directories read, in order, for the include cache
+	env    []string          // environment variables referenced by include paths
+	sums   map[string]string // hex SHA-256 of each remote include fetched
+}
+
+// includeDep is a file or directory that include expansion depended on
+type includeDep struct {
+	path string
+	dir  bool
+}
+
+// newIncludeState creates an empty includeState
+func newIncludeState() *includeState {
+	return &includeState{
+		active: make(map[string]bool),
+		seen:   make(map[string]bool),
+		sums:   make(map[string]string),
+	}
+}
+
+// processIncludes processes @include directives in KDL files
+func processIncludes(filename string, state *includeState) (string, error) {
+	content, _, err := includeSource(filename, state)
+	return content, err
+}
+
+// lineOrigin is the file and 1-based line an include-expanded line came from
+type lineOrigin struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	ArgNames []string `json:"arg_names,omitempty"` // names from the @argnames directive in scope
+}
+
+// String formats the origin as file:line
+func (o lineOrigin) String() string {
+	return fmt.Sprintf("%s:%d", displayPath(o.File), o.Line)
+}
+
+// displayPath returns file relative to the working directory when it is below it
+func displayPath(file string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return file
+}
+
+// includeSource expands the includes of filename like processIncludes, also returning the
+// origin of every line of the expanded text
+func includeSource(filename string, state *includeState) (string, []lineOrigin, error) {
+	// Check for circular includes
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get absolute path for %s: %v", filename, err)
+	}
+
+	// Symlinked paths to one file are the same file when resolving symlinks
+	key := absPath
+	if resolveSymlinks {
+		if key, err = filepath.EvalSymlinks(absPath); err != nil {
+			return "", nil, fmt.Errorf("failed to resolve symlinks for %s: %v", filename, err)
+		}
+	}
+
+	if state.active[key] {
+		return "", nil, fmt.Errorf("circular include detected: %s", filename)
+	}
+
+	// Repeated (non-circular) includes are spliced again unless deduplication is enabled
+	if dedupeIncludes && state.seen[key] {
+		return "", nil, nil
+	}
+
+	// Guard against include graphs that pull in too many files
+	if maxFiles > 0 && !state.seen[key] && len(state.seen) >= maxFiles {
+		return "", nil, fmt.Errorf("include limit exceeded: %s would be file %d (limit %d)", filename, len(state.seen)+1, maxFiles)
+	}
+
+	state.active[key] = true
+	defer delete(state.active, key)
+	state.seen[key] = true
+
+	// Deduplication depends on what was included before, so those results can't be cached,
+	// cached files would skip the lints, cached dependencies aren't symlink-resolved, and
+	// include validation skips @include-only selection, so its expansion must not be stored
+	if cacheDir != "" && !dedupeIncludes && maxLineLength == 0 && !lintIndentation && !resolveSymlinks && !validateIncludesOnly {
+		return cachedIncludes(filename, absPath, state)
+	}
+	return expandIncludes(filename, absPath, state)
+}
+
+// isRemoteInclude reports whether an include target is a URL to fetch
+func isRemoteInclude(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// remoteSource fetches the include at url, verifying it against checksum (a hex SHA-256) when
+// one is given. Remote fragments are spliced as they are and may not include other files.
+func remoteSource(url, checksum string, state *includeState) (string, []lineOrigin, error) {
+	if !allowRemoteIncludes {
+		return "", nil, fmt.Errorf("remote includes are disabled (use -allow-remote-includes to fetch %s)", url)
+	}
+	if dedupeIncludes && state.seen[url] {
+		// The skipped directive's pin must still hold for the content already spliced
+		if err := verifyChecksum(url, checksum, state.sums[url]); err != nil {
+			return "", nil, err
+		}
+		return "", fileOrigins(url, 1, 1), nil
+	}
+	if maxFiles > 0 && !state.seen[url] && len(state.seen) >= maxFiles {
+		return "", nil, fmt.Errorf("include limit exceeded: %s would be file %d (limit %d)", url, len(state.seen)+1, maxFiles)
+	}
+	state.seen[url] = true
+
+	// A URL can't be checked for changes, so files including it are never cached
+	state.deps = append(state.deps, includeDep{path: url})
+
+	client := http.Client{Timeout: remoteIncludeTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+
+	// Fail closed: content that doesn't match its pinned checksum is never used
+	sum := sha256.Sum256(data)
+	state.sums[url] = hex.EncodeToString(sum[:])
+	if err := verifyChecksum(url, checksum, state.sums[url]); err != nil {
+		return "", nil, err
+	}
+
+	if offset := invalidUTF8Offset(data); offset >= 0 {
+		if !allowInvalidUTF8 {
+			return "", nil, fmt.Errorf("invalid UTF-8 in %s at byte offset %d", url, offset)
+		}
+		data = bytes.ToValidUTF8(data, nil)
+	}
+
+	content := string(data)
+	lines := strings.Split(content, "\n")
+	lintLineLengths(url, lines)
+	lintMixedIndentation(url, lines)
+	for i, line := range lines {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, includeDirective) || strings.HasPrefix(trimmed, repeatDirective) {
+			return "", nil, fmt.Errorf("%s:%d: remote includes may not include other files", url, i+1)
+		}
+	}
+	return content, fileOrigins(url, 1, len(lines)), nil
+}
+
+// verifyChecksum checks the hex SHA-256 actual of the content fetched from url against the
+// pinned checksum, if there is one
+func verifyChecksum(url, checksum, actual string) error {
+	if checksum != "" && !strings.EqualFold(actual, checksum) {
+		return fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", url, strings.ToLower(checksum), actual)
+	}
+	return nil
+}
+
+// lintMixedIndentation warns about each line of filename whose indentation mixes tabs and
+// spaces, or uses a different one than the first indented line of the file
+func lintMixedIndentation(filename string, lines []string) {
+	if !lintIndentation {
+		return
+	}
+	var style byte // indentation character of the first indented line
+	styleLine := 0
+	for i, line := range lines {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if indent == "" || strings.TrimSpace(line) == "" {
+			continue
+		}
+		switch {
+		case strings.Contains(indent, "\t") && strings.Contains(indent, " "):
+			warnf("%s:%d: indentation mixes tabs and spaces", displayPath(filename), i+1)
+		case style == 0:
+			style, styleLine = indent[0], i+1
+		case indent[0] != style:
+			warnf("%s:%d: indented with %s, but line %d is indented with %s", displayPath(filename), i+1, indentName(indent[0]), styleLine, indentName(style))
+		}
+	}
+}
+
+// indentName names an indentation character for lint warnings
+func indentName(c byte) string {
+	if c == '\t' {
+		return "tabs"
+	}
+	return "spaces"
+}
+
+// lintLineLengths warns about each line of filename longer than -max-line-length characters
+func lintLineLengths(filename string, lines []string) {
+	if maxLineLength == 0 {
+		return
+	}
+	for i, line := range lines {
+		if length := utf8.RuneCountInString(strings.TrimSuffix(line, "\r")); length > maxLineLength {
+			warnf("%s:%d: line is %d characters long (limit %d)", displayPath(filename), i+1, length, maxLineLength)
+		}
+	}
+}
+
+// expandIncludes reads filename and splices in the files its @include directives refer to
+func expandIncludes(filename, absPath string, state *includeState) (string, []lineOrigin, error) {
+	state.deps = append(state.deps, includeDep{path: absPath})
+
+	// Read the file
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read file %s: %v", filename, err)
+	}
+
+	// Reject malformed UTF-8 with its location, or replace it when explicitly allowed
+	if offset := invalidUTF8Offset(data); offset >= 0 {
+		if !allowInvalidUTF8 {
+			return "", nil, fmt.Errorf("invalid UTF-8 in %s at byte offset %d", filename, offset)
+		}
+		// The parser rejects U+FFFD as well, so the bytes are dropped rather than replaced
+		data = bytes.ToValidUTF8(data, nil)
+	}
+
+	content := string(data)
+	lines := strings.Split(content, "\n")
+	lintLineLengths(absPath, lines)
+	lintMixedIndentation(absPath, lines)
+
+	// Check if file contains @include directives
+	if !strings.Contains(content, includeDirective) && !strings.Contains(content, repeatDirective) && !strings.Contains(content, argNamesDirective) {
+		// No includes, return content as-is
+		return content, fileOrigins(absPath, 1, len(lines)), nil
+	}
+
+	argNames, err := fileArgNames(filename, lines)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var result []string
+	var origins []lineOrigin
+	lineNo := 1
+
+	// Process each line for @include directives
+	includeRegex := regexp.MustCompile(`^\s*(?:` + regexp.QuoteMeta(includeDirective) + `(-only)?|` + repeatDirective + `\s+(\d+))\s+"([^"]+)"`)
+
+	// A directive may span "\" line continuations, and a continued line never starts one
+	for _, group := range continuedLines(lines) {
+		line := joinContinuedLines(group)
+		groupStart := lineNo
+		lineNo += len(group)
+		if argNamesRegex.MatchString(line) {
+			// The directive was read above; blank lines keep the origins aligned
+			result = append(result, make([]string, len(group))...)
+			origins = append(origins, fileOrigins(absPath, groupStart, len(group))...)
+		} else if matches := includeRegex.FindStringSubmatch(line); matches != nil {
+			includeFile := matches[3]
+			rest := line[len(matches[0]):]
+
+			// @repeat N includes the file N times, numbering the copies with ${index}
+			repeat := 1
+			if matches[2] != "" {
+				repeat, err = strconv.Atoi(matches[2])
+				if err != nil {
+					return "", nil, fmt.Errorf("invalid %s count %s", repeatDirective, matches[2])
+				}
+				if repeat > maxRepeatCount {
+					return "", nil, fmt.Errorf("%s count %d exceeds the limit of %d", repeatDirective, repeat, maxRepeatCount)
+				}
+				if maxFiles > 0 && repeat > maxFiles {
+					return "", nil, fmt.Errorf("%s count %d exceeds the -max-files limit of %d", repeatDirective, repeat, maxFiles)
+				}
+			}
+
+			// The -only variant lists the node names to keep from the included file
+			var onlyNames []string
+			if matches[1] != "" {
+				onlyNames, rest = parseIncludeOnlyNames(rest)
+				if len(onlyNames) == 0 {
+					return "", nil, fmt.Errorf("%s-only %q names no nodes to include", includeDirective, includeFile)
+				}
+			}
+			params := parseIncludeParams(rest)
+
+			// Expand environment variables in the include target
+			includePath, err := expandIncludePath(includeFile)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to process include %s: %v", includeFile, err)
+			}
+			os.Expand(includeFile, func(name string) string {
+				state.env = append(state.env, name)
+				return ""
+			})
+
+			// URLs are fetched rather than read, and may be pinned by a sha256="..." checksum
+			if isRemoteInclude(includePath) {
+				checksum := params["sha256"]
+				delete(params, "sha256")
+				remoteContent, remoteOrigins, err := remoteSource(includePath, checksum, state)
+				if err != nil {
+					return "", nil, fmt.Errorf("failed to process include %s: %v", includeFile, err)
+				}
+				for index := 0; index < repeat; index++ {
+					if matches[2] != "" {
+						params["index"] = strconv.Itoa(index)
+					}
+					includedContent, includedOrigins := substituteIncludeParams(remoteContent, params), remoteOrigins
+					if onlyNames != nil && !validateIncludesOnly {
+						includedContent, includedOrigins, err = filterIncludedNodes(includedContent, includedOrigins, onlyNames)
+						if err != nil {
+							return "", nil, fmt.Errorf("failed to process include %s: %v", includeFile, err)
+						}
+					}
+					result = append(result, includedContent)
+					origins = append(origins, includedOrigins...)
+				}
+				continue
+			}
+
+			// Resolve relative path
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(filepath.Dir(filename), includePath)
+			}
+
+			// Directories and glob patterns include every matching file in order
+			targets, err := expandIncludeTarget(includePath)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to process include %s: %v", includeFile, err)
+			}
+			if len(targets) != 1 || targets[0] != includePath {
+				dir := includePath
+				if strings.ContainsAny(includePath, "*?[") {
+					dir = filepath.Dir(includePath)
+				}
+				if absDir, err := filepath.Abs(dir); err == nil {
+					state.deps = append(state.deps, includeDep{path: absDir, dir: true})
+				}
+			}
+
+			for _, target := range targets {
+				// Process the included file
+				targetContent, targetOrigins, err := includeSource(target, state)
+				if err != nil {
+					return "", nil, fmt.Errorf("failed to process include %s: %v", includeFile, err)
+				}
+
+				for index := 0; index < repeat; index++ {
+					includedContent, includedOrigins := targetContent, targetOrigins
+
+					// Substitute the included content's parameters
+					if matches[2] != "" {
+						params["index"] = strconv.Itoa(index)
+					}
+					includedContent = substituteIncludeParams(includedContent, params)
+
+					// Lines without a known origin, e.g. skipped duplicates, belong to the directive
+					if count := strings.Count(includedContent, "\n") + 1; len(includedOrigins) != count {
+						includedOrigins = make([]lineOrigin, count)
+						for i := range includedOrigins {
+							includedOrigins[i] = lineOrigin{File: absPath, Line: groupStart}
+						}
+					}
+
+					// Selecting nodes parses the fragment, which include validation must not do
+					if onlyNames != nil && !validateIncludesOnly {
+						includedContent, includedOrigins, err = filterIncludedNodes(includedContent, includedOrigins, onlyNames)
+						if err != nil {
+							return "", nil, fmt.Errorf("failed to process include %s: %v", includeFile, err)
+						}
+					}
+					result = append(result, includedContent)
+					origins = append(origins, includedOrigins...)
+				}
+			}
+		} else {
+			result = append(result, group...)
+			origins = append(origins, fileOrigins(absPath, groupStart, len(group))...)
+		}
+	}
+
+	// The file's argument names apply to its own lines and to included files without their own
+	if argNames != nil {
+		for i := range origins {
+			if origins[i].ArgNames == nil {
+				origins[i].ArgNames = argNames
+			}
+		}
+	}
+
+	return strings.Join(result, "\n"), origins, nil
+}
+
+// fileArgNames returns the names given by the @argnames directive among lines, or nil if
+// there is none. A file may declare its argument names only once.
+func fileArgNames(filename string, lines []string) ([]string, error) {
+	var names []string
+	directiveLine := 0
+	lineNo := 1
+	for _, group := range continuedLines(lines) {
+		groupStart := lineNo
+		lineNo += len(group)
+		matches := argNamesRegex.FindStringSubmatch(joinContinuedLines(group))
+		if matches == nil {
+			continue
+		}
+		if directiveLine != 0 {
+			return nil, fmt.Errorf("%s:%d: %s already appears on line %d", filename, groupStart, argNamesDirective, directiveLine)
+		}
+		names, _ = parseIncludeOnlyNames(matches[1])
+		if len(names) == 0 {
+			return nil, fmt.Errorf("%s:%d: %s names no arguments", filename, groupStart, argNamesDirective)
+		}
+		directiveLine = groupStart
+	}
+	return names, nil
+}
+
+// fileOrigins returns the origins of count consecutive lines of file starting at line first
+func fileOrigins(file string, first, count int) []lineOrigin {
+	origins := make([]lineOrigin, count)
+	for i := range origins {
+		origins[i] = lineOrigin{File: file, Line: first + i}
+	}
+	return origins
+}
+
+// includeCacheEntry is the cached expansion of one file, valid while its dependencies are unchanged
+type includeCacheEntry struct {
+	Settings string            `json:"settings"`
+	Deps     []includeCacheDep `json:"deps"`
+	Env      map[string]string `json:"env,omitempty"`
+	Content  string            `json:"content"`
+	Origins  []lineOrigin      `json:"origins"`
+}
+
+// includeCacheDep records the state of a file or directory when the entry was written
+type includeCacheDep struct {
+	Path    string `json:"path"`
+	Dir     bool   `json:"dir,omitempty"`
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+}
+
+// cachedIncludes returns the cached expansion of filename if none of the files, directories and
+// environment variables it depended on have changed, and expands and caches it otherwise.
+func cachedIncludes(filename, absPath string, state *includeState) (string, []lineOrigin, error) {
+	settings := includeCacheSettings()
+	sum := sha256.Sum256([]byte(absPath))
+	cachePath := filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".json")
+
+	if entry, ok := loadIncludeCache(cachePath, settings, absPath, state); ok {
+		// Account for the files the cached expansion included
+		for _, dep := range entry.Deps {
+			if dep.Dir || state.seen[dep.Path] {
+				continue
+			}
+			if maxFiles > 0 && len(state.seen) >= maxFiles {
+				return "", nil, fmt.Errorf("include limit exceeded: %s would be file %d (limit %d)", dep.Path, len(state.seen)+1, maxFiles)
+			}
+			state.seen[dep.Path] = true
+		}
+		for _, dep := range entry.Deps {
+			state.deps = append(state.deps, includeDep{path: dep.Path, dir: dep.Dir})
+		}
+		for name := range entry.Env {
+			state.env = append(state.env, name)
+		}
+		return entry.Content, entry.Origins, nil
+	}
+
+	depStart, envStart := len(state.deps), len(state.env)
+	content, origins, err := expandIncludes(filename, absPath, state)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Failing to write the cache only costs performance
+	entry := includeCacheEntry{Settings: settings, Env: make(map[string]string), Content: content, Origins: origins}
+	for _, dep := range state.deps[depStart:] {
+		info, err := os.Stat(dep.path)
+		if err != nil {
+			return content, origins, nil
+		}
+		entry.Deps = append(entry.Deps, includeCacheDep{Path: dep.path, Dir: dep.dir, ModTime: info.ModTime().UnixNano(), Size: info.Size()})
+	}
+	for _, name := range state.env[envStart:] {
+		entry.Env[name] = os.Getenv(name)
+	}
+	if err := writeIncludeCache(cachePath, entry); err != nil {
+		warnf("failed to write include cache: %v", err)
+	}
+	return content, origins, nil
+}
+
+// loadIncludeCache reads the cache entry at cachePath and reports whether it is still valid
+func loadIncludeCache(cachePath, settings, absPath string, state *includeState) (includeCacheEntry, bool) {
+	var entry includeCacheEntry
+	data, err := os.ReadFile(cachePath)
+	if err != nil || json.Unmarshal(data, &entry) != nil {
+		return entry, false
+	}
+	if entry.Settings != settings || len(entry.Deps) == 0 || entry.Deps[0].Path != absPath {
+		return entry, false
+	}
+	if len(entry.Origins) != strings.Count(entry.Content, "\n")+1 {
+		return entry, false
+	}
+
+	for _, dep := range entry.Deps {
+		// Let expansion report include cycles through the files on the current stack
+		if !dep.Dir && dep.Path != absPath && state.active[dep.Path] {
+			return entry, false
+		}
+		info, err := os.Stat(dep.Path)
+		if err != nil || info.ModTime().UnixNano() != dep.ModTime || info.Size() != dep.Size {
+			return entry, false
+		}
+	}
+	for name, value := range entry.Env {
+		if current, ok := os.LookupEnv(name); !ok || current != value {
+			return entry, false
+		}
+	}
+	return entry, true
+}
+
+// writeIncludeCache atomically writes entry to cachePath
+func writeIncludeCache(cachePath string, entry includeCacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+// includeCacheSettings describes the options that change how files are expanded, so entries
+// written under different options are not reused
+func includeCacheSettings() string {
+	settings := fmt.Sprintf("include-directive=%q allow-invalid-utf8=%v", includeDirective, allowInvalidUTF8)
+	if includeIgnoreFile != "" {
+		ignorePath, _ := filepath.Abs(includeIgnoreFile)
+		settings += " include-ignore=" + ignorePath
+		if info, err := os.Stat(includeIgnoreFile); err == nil {
+			settings += fmt.Sprintf("@%d", info.ModTime().UnixNano())
+		}
+	}
+	return settings
+}
+
+// Matches a KDL line continuation: a backslash optionally followed by whitespace and a comment
+var lineContinuationRegex = regexp.MustCompile(`\\\s*(//.*)?$`)
+
+// continuedLines groups lines into logical lines, joining each line that ends in a "\"
+// continuation with the lines it continues onto
+func continuedLines(lines []string) [][]string {
+	var groups [][]string
+	var current []string
+	for _, line := range lines {
+		current = append(current, line)
+		if strings.HasPrefix(strings.TrimSpace(line), "//") || !lineContinuationRegex.MatchString(line) {
+			groups = append(groups, current)
+			current = nil
+		}
+	}
+	if current != nil {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// joinContinuedLines joins a logical line's physical lines, dropping the continuations
+func joinContinuedLines(group []string) string {
+	parts := make([]string, len(group))
+	for i, line := range group {
+		if i < len(group)-1 {
+			line = lineContinuationRegex.ReplaceAllString(line, "")
+		}
+		parts[i] = line
+	}
+	return strings.Join(parts, " ")
+}
+
+var (
+	includeOnlyRegex  = regexp.MustCompile(`^\s+"([^"]+)"`)
+	includeParamRegex = regexp.MustCompile(`([A-Za-z_][\w-]*)="((?:[^"\\]|\\.)*)"`)
+	paramRefRegex     = regexp.MustCompile(`\$\{([A-Za-z_][\w-]*)\}`)
+)
+
+// parseIncludeOnlyNames parses the quoted node names following the path of an @include-only
+// directive, returning them and the rest of the line
+func parseIncludeOnlyNames(text string) ([]string, string) {
+	var names []string
+	for {
+		match := includeOnlyRegex.FindStringSubmatch(text)
+		if match == nil {
+			return names, text
+		}
+		names = append(names, match[1])
+		text = text[len(match[0]):]
+	}
+}
+
+// filterIncludedNodes keeps only the top-level nodes of content with one of the given names,
+// along with the origins of their lines
+func filterIncludedNodes(content string, origins []lineOrigin, names []string) (string, []lineOrigin, error) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+
+	var chunks []string
+	var kept []lineOrigin
+	for _, info := range scanNodes(content) {
+		// Nodes end after their terminating newline, which the join restores
+		chunk := strings.TrimRight(content[info.start:info.end], "\r\n")
+		doc, err := kdl.Parse(strings.NewReader(chunk))
+		if err != nil {
+			return "", nil, fmt.Errorf("node at line %d: %v", info.line, err)
+		}
+		if len(doc.Nodes) != 1 || !keep[nodeKey(doc.Nodes[0])] {
+			continue
+		}
+
+		first := strings.Count(content[:info.start], "\n")
+		count := strings.Count(chunk, "\n") + 1
+		chunks = append(chunks, chunk)
+		if first+count <= len(origins) {
+			kept = append(kept, origins[first:first+count]...)
+		}
+	}
+
+	// An include with no matching nodes still contributes one (empty) line
+	if len(chunks) == 0 {
+		return "", origins[:1], nil
+	}
+	return strings.Join(chunks, "\n"), kept, nil
+}
+
+// parseIncludeParams parses key="value" parameters following an include path. Values are kept
+// exactly as written, escapes included, so they can be substituted inside KDL strings.
+func parseIncludeParams(text string) map[string]string {
+	params := make(map[string]string)
+	for _, match := range includeParamRegex.FindAllStringSubmatch(text, -1) {
+		params[match[1]] = match[2]
+	}
+	return params
+}
+
+// substituteIncludeParams replaces ${key} references in content with the include's parameters.
+// References to names that aren't parameters are left untouched.
+func substituteIncludeParams(content string, params map[string]string) string {
+	if len(params) == 0 {
+		return content
+	}
+	return paramRefRegex.ReplaceAllStringFunc(content, func(ref string) string {
+		if value, ok := params[ref[2:len(ref)-1]]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// invalidUTF8Offset returns the byte offset of the first invalid UTF-8 sequence in data, or -1
+func invalidUTF8Offset(data []byte) int {
+	for offset := 0; offset < len(data); {
+		r, size := utf8.DecodeRune(data[offset:])
+		if r == utf8.RuneError && size == 1 {
+			return offset
+		}
+		offset += size
+	}
+	return -1
+}
+
+// loadManifest reads a manifest listing KDL files, one per line, and returns their processed
+// content concatenated in order. Blank lines and lines starting with # are ignored; relative
+// paths are resolved against the manifest's directory.
+func loadManifest(manifest string, state *includeState) (string, error) {
+	content, _, err := manifestSource(manifest, state)
+	return content, err
+}
+
+// manifestSource loads a manifest like loadManifest, also returning the origin of every line
+func manifestSource(manifest string, state *includeState) (string, []lineOrigin, error) {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read manifest %s: %v", manifest, err)
+	}
+
+	absManifest, err := filepath.Abs(manifest)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get absolute path for %s: %v", manifest, err)
+	}
+
+	var parts []string
+	var origins []lineOrigin
+	for i, line := range strings.Split(string(data), "\n") {
+		entry := strings.TrimSpace(line)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		if !filepath.IsAbs(entry) {
+			entry = filepath.Join(filepath.Dir(manifest), entry)
+		}
+
+		content, entryOrigins, err := includeSource(entry, state)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to process manifest entry %s: %v", entry, err)
+		}
+		parts = append(parts, content)
+		origins = append(origins, entryOrigins...)
+		// A skipped duplicate contributes an empty line, attributed to the manifest entry
+		if len(entryOrigins) == 0 {
+			origins = append(origins, lineOrigin{File: absManifest, Line: i + 1})
+		}
+	}
+
+	return strings.Join(parts, "\n"), origins, nil
+}
+
+// validateIncludes resolves the include graph of each of filenames, failing on the first
+// missing target or include cycle. The KDL itself is never parsed.
+func validateIncludes(filenames []string) error {
+	for _, filename := range filenames {
+		if _, err := processIncludes(filename, newIncludeState()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listIncludes resolves the include graph of filename and returns the sorted absolute paths
+// of every file involved, including filename itself
+func listIncludes(filename string) ([]string, error) {
+	state := newIncludeState()
+	if _, err := processIncludes(filename, state); err != nil {
+		return nil, err
+	}
+	return seenFiles(state), nil
+}
+
+// listManifestIncludes resolves the include graph of every entry in manifest and returns the
+// sorted absolute paths of every file involved
+func listManifestIncludes(manifest string) ([]string, error) {
+	state := newIncludeState()
+	if _, _, err := manifestSource(manifest, state); err != nil {
+		return nil, err
+	}
+	return seenFiles(state), nil
+}
+
+// seenFiles returns the sorted paths of the files state has loaded
+func seenFiles(state *includeState) []string {
+	files := make([]string, 0, len(state.seen))
+	for file := range state.seen {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// writeDepFile writes a Makefile rule to path stating that target depends on filename and
+// every file it includes
+func writeDepFile(path, target, filename string) error {
+	if target == "" {
+		return fmt.Errorf("-depfile requires -output to name the target")
+	}
+	if flag.NArg() > 1 || manifestFile != "" || inputGlob != "" {
+		return fmt.Errorf("-depfile accepts a single input file")
+	}
+
+	files, err := listIncludes(filename)
+	if err != nil {
+		return includeError(err)
+	}
+	return os.WriteFile(path, []byte(depRule(target, filename, files)), 0644)
+}
+
+// depRule formats a Makefile rule "target: input deps...", listing the input first and the
+// other files in sorted order. Paths below the working directory are made relative.
+func depRule(target, input string, files []string) string {
+	absInput, _ := filepath.Abs(input)
+	deps := []string{makeEscape(displayPath(absInput))}
+	for _, file := range files {
+		if file != absInput {
+			deps = append(deps, makeEscape(displayPath(file)))
+		}
+	}
+	return makeEscape(target) + ": " + strings.Join(deps, " ") + "\n"
+}
+
+// makeEscape escapes the characters that are special in Makefile target and prerequisite names
+func makeEscape(name string) string {
+	return strings.NewReplacer(" ", `\ `, "$", "$$", "#", `\#`).Replace(name)
+}
+
+// expandIncludePath expands $VAR and ${VAR} references in an include target.
+// Referencing an undefined variable is an error rather than silently expanding to an empty string.
+func expandIncludePath(path string) (string, error) {
+	var missing []string
+	expanded := os.Expand(path, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variable %s in include path %q", missing[0], path)
+	}
+	return expanded, nil
+}
+
+// expandIncludeTarget returns the files an include path refers to: the path itself, the sorted
+// *.kdl files of a directory, or the sorted matches of a glob pattern. Files matching the
+// -include-ignore patterns are skipped when expanding directories and globs.
+func expandIncludeTarget(path string) ([]string, error) {
+	pattern := path
+	if !strings.ContainsAny(path, "*?[") {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			return []string{path}, nil
+		}
+		pattern = filepath.Join(path, "*.kdl")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q: %v", path, err)
+	}
+
+	var targets []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			continue
+		}
+		if isIgnored(match) {
+			continue
+		}
+		targets = append(targets, match)
+	}
+	return targets, nil
+}
+
+// ignoreRule is one pattern from an -include-ignore file
+type ignoreRule struct {
+	pattern string // slash-separated glob
+	negate  bool   // a "!" pattern re-includes files excluded by earlier patterns
+	base    string // directory of the ignore file; set for patterns containing a slash
+}
+
+// loadIgnoreFile reads gitignore-style patterns: blank lines and # comments are skipped,
+// "!" negates a pattern, and patterns containing a slash match paths relative to the
+// ignore file's directory while others match the file name.
+func loadIgnoreFile(filename string) ([]ignoreRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file %s: %v", filename, err)
+	}
+
+	base, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %s: %v", filename, err)
+	}
+
+	var rules []ignoreRule
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.Contains(line, "/") {
+			rule.base = base
+			line = strings.TrimPrefix(line, "/")
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q: %v", filename, i+1, line, err)
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// isIgnored reports whether path matches the -include-ignore patterns; the last matching rule wins
+func isIgnored(filename string) bool {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+
+	ignored := false
+	for _, rule := range includeIgnoreRules {
+		name := filepath.Base(absPath)
+		if rule.base != "" {
+			rel, err := filepath.Rel(rule.base, absPath)
+			if err != nil {
+				continue
+			}
+			name = filepath.ToSlash(rel)
+		}
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func convertKDLToJSON(doc *document.Document) ([]byte, error) {
+	result, err := convertDocument(nil, doc)
+	if err != nil {
+		return nil, err
+	}
+	return marshalJSON(result)
+}
+
+// marshalJSON marshals v as indented JSON, escaping HTML characters unless -no-escape-html is set
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(!noEscapeHTML)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	// Encode terminates the value with a newline; callers decide how output ends
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// convertDocument converts a KDL document to the map structure that is marshaled as JSON
+func convertDocument(infos nodeInfos, doc *document.Document) (map[string]interface{}, error) {
+	// Separate @defaults blocks from the regular document nodes
+	nodes, defaultBlocks := splitDefaults(doc.Nodes)
+
+	// Take out the document's schema node
+	var schemaNodes []*document.Node
+	if schemaNodeName != "" {
+		nodes, schemaNodes = splitSchemaNodes(nodes)
+		if len(schemaNodes) > 1 {
+			return nil, fmt.Errorf("schema node %q appears %d times", schemaNodeName, len(schemaNodes))
+		}
+	}
+
+	// Convert KDL document to a map structure
+	result, err := convertNodeList(infos, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemaNodes) == 1 {
+		schema, err := convertNodeToValue(infos, schemaNodes[0])
+		if err != nil {
+			return nil, wrapNodeError(schemaNodeName, err)
+		}
+		if err := setMetaKey(result, "schema", schema); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill in default values the document didn't specify
+	for _, block := range defaultBlocks {
+		defaults, err := convertDefaults(infos, block)
+		if err != nil {
+			return nil, wrapNodeError(defaultsNodeName, err)
+		}
+		mergeDefaults(result, defaults)
+	}
+
+	return result, nil
+}
+
+// splitDefaults separates @defaults blocks from the regular top-level nodes
+func splitDefaults(nodes []*document.Node) ([]*document.Node, []*document.Node) {
+	var regular, defaults []*document.Node
+	for _, node := range nodes {
+		if node.Name.NodeNameString() == defaultsNodeName {
+			defaults = append(defaults, node)
+		} else {
+			regular = append(regular, node)
+		}
+	}
+	return regular, defaults
+}
+
+// splitSchemaNodes separates the top-level nodes named by -schema-node from the rest
+func splitSchemaNodes(nodes []*document.Node) ([]*document.Node, []*document.Node) {
+	var regular, schema []*document.Node
+	for _, node := range nodes {
+		if nodeKey(node) == schemaNodeName {
+			schema = append(schema, node)
+		} else {
+			regular = append(regular, node)
+		}
+	}
+	return regular, schema
+}
+
+// convertDefaults converts the properties and children of a @defaults block into a map
+func convertDefaults(infos nodeInfos, block *document.Node) (map[string]interface{}, error) {
+	defaults, err := convertNodeList(infos, block.Children)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range propertyNames(block) {
+		value := block.Properties[name]
+		if _, exists := defaults[name]; !exists {
+			converted, err := resolveProperty(infos, block, name, value)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %v", name, err)
+			}
+			defaults[name] = converted
+		}
+	}
+	return defaults, nil
+}
+
+// mergeDefaults copies values from defaults into dst wherever dst doesn't already define them.
+// Nested objects are merged recursively; any other value in dst wins over the default.
+func mergeDefaults(dst, defaults map[string]interface{}) {
+	for key, defaultValue := range defaults {
+		value, exists := dst[key]
+		if !exists {
+			dst[key] = defaultValue
+			continue
+		}
+
+		valueObj, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if defaultObj, ok := defaultValue.(map[string]interface{}); ok {
+			mergeDefaults(valueObj, defaultObj)
+		}
+	}
+}
+
+// nodeError is a conversion error annotated with the path of the node that caused it
+type nodeError struct {
+	path []string
+	err  error
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("node %s: %v", strings.Join(e.path, "."), e.err)
+}
+
+// wrapNodeError prepends a node name to the path of a conversion error
+func wrapNodeError(name string, err error) error {
+	if ne, ok := err.(*nodeError); ok {
+		return &nodeError{path: append([]string{name}, ne.path...), err: ne.err}
+	}
+	return &nodeError{path: []string{name}, err: err}
+}
+
+// nodeKey returns the output key for a node: its name, lowercased with -case-insensitive-names
+func nodeKey(node *document.Node) string {
+	key := node.Name.NodeNameString()
+	if caseInsensitiveNames {
+		key = strings.ToLower(key)
+	}
+	if alias, ok := nodeAliases[key]; ok {
+		return alias
+	}
+	return key
+}
+
+// findNodePath returns the node at a dotted path of node names such as "scene.node". Where
+// several sibling nodes share a name, as when they form an array in the output, a numeric
+// segment selects one of them, e.g. "item.1".
+func findNodePath(nodes []*document.Node, path string) (*document.Node, error) {
+	segments := strings.Split(path, ".")
+	var node *document.Node
+	for i := 0; i < len(segments); i++ {
+		var matches []*document.Node
+		for _, candidate := range nodes {
+			if nodeKey(candidate) == segments[i] {
+				matches = append(matches, candidate)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no node at %s", strings.Join(segments[:i+1], "."))
+		}
+
+		node = matches[0]
+		if len(matches) > 1 {
+			if i+1 == len(segments) {
+				return nil, fmt.Errorf("%s matches %d nodes; add an index such as %s.0", path, len(matches), path)
+			}
+			index, err := strconv.Atoi(segments[i+1])
+			if err != nil || index < 0 || index >= len(matches) {
+				return nil, fmt.Errorf("no node at %s", strings.Join(segments[:i+2], "."))
+			}
+			node = matches[index]
+			i++
+		}
+		nodes = node.Children
+	}
+	return node, nil
+}
+
+// convertNodeList converts a list of top-level nodes to a map, grouping duplicates into arrays
+func convertNodeList(infos nodeInfos, nodes []*document.Node) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+
+	// Property-only subtrees are hoisted into this level instead of converting to objects
+	hoisted := make(map[string]interface{})
+	hoistedFrom := make(map[string]string) // collapsed node each hoisted key came from
+
+	// Group nodes by name to handle duplicates
+	nodeGroups := make(map[string][]*document.Node)
+	var order []string
+	for _, node := range nodes {
+		key := nodeKey(node)
+		if collapseProperties && collapsible(node) {
+			props, err := collapsedProperties(infos, node)
+			if err != nil {
+				return nil, wrapNodeError(key, err)
+			}
+			if err := hoistProperties(hoisted, key, props); err != nil {
+				return nil, err
+			}
+			for prop := range props {
+				hoistedFrom[key+collapseDelimiter+prop] = key
+			}
+			continue
+		}
+		checkMetaPrefix(key)
+		if _, ok := nodeGroups[key]; !ok {
+			order = append(order, key)
+		}
+		nodeGroups[key] = append(nodeGroups[key], node)
+	}
+
+	// Process each group in order of first appearance, so the first failing node is the one reported
+	for _, key := range order {
+		nodes := nodeGroups[key]
+		if noGroup {
+			// Earlier nodes are overwritten, so only the last one is converted
+			nodes = nodes[len(nodes)-1:]
+		}
+		if len(nodes) == 1 {
+			// Single node
+			value, err := convertNodeToValue(infos, nodes[0])
+			if err != nil {
+				return nil, wrapNodeError(key, err)
+			}
+			if value, err = withNodeSource(infos, nodes[0], value); err != nil {
+				return nil, wrapNodeError(key, err)
+			}
+			result[key] = value
+		} else {
+			// Multiple nodes with same name - create array
+			nodeArray := make([]interface{}, len(nodes))
+			for i, node := range nodes {
+				value, err := convertNodeToValue(infos, node)
+				if err != nil {
+					return nil, wrapNodeError(fmt.Sprintf("%s[%d]", key, i), err)
+				}
+				if value, err = withNodeSource(infos, node, value); err != nil {
+					return nil, wrapNodeError(fmt.Sprintf("%s[%d]", key, i), err)
+				}
+				nodeArray[i] = value
+			}
+			if dedupArrays {
+				nodeArray = dedupValues(nodeArray)
+			}
+			result[key] = nodeArray
+		}
+
+		if prop, ok := keyByProps[key]; ok {
+			items := []interface{}{result[key]}
+			if len(nodes) > 1 {
+				items = result[key].([]interface{})
+			}
+			keyed, err := keyByProperty(items, prop)
+			if err != nil {
+				return nil, wrapNodeError(key, err)
+			}
+			result[key] = keyed
+		}
+	}
+
+	for key, value := range hoisted {
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("property %q hoisted from collapsed node %q collides with an existing child node named %q", strings.TrimPrefix(key, hoistedFrom[key]+collapseDelimiter), hoistedFrom[key], key)
+		}
+		result[key] = value
+	}
+
+	return result, nil
+}
+
+// collapsible reports whether -collapse-properties hoists node into its parent: it has no
+// arguments, and only properties and children that are collapsible in turn
+func collapsible(node *document.Node) bool {
+	if len(node.Arguments) > 0 || len(node.Properties)+len(node.Children) == 0 {
+		return false
+	}
+	for _, child := range node.Children {
+		if !collapsible(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// collapsedProperties returns the properties of a collapsible node, including those hoisted
+// from its children
+func collapsedProperties(infos nodeInfos, node *document.Node) (map[string]interface{}, error) {
+	props := make(map[string]interface{})
+	if err := addProperties(infos, props, node); err != nil {
+		return nil, err
+	}
+	for _, child := range node.Children {
+		childProps, err := collapsedProperties(infos, child)
+		if err != nil {
+			return nil, wrapNodeError(nodeKey(child), err)
+		}
+		if err := hoistProperties(props, nodeKey(child), childProps); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// hoistProperties adds props to obj under keys prefixed with name and -collapse-delimiter,
+// failing when a key is already set
+func hoistProperties(obj map[string]interface{}, name string, props map[string]interface{}) error {
+	for prop, value := range props {
+		key := name + collapseDelimiter + prop
+		if _, ok := obj[key]; ok {
+			return fmt.Errorf("collapsed property %q is set more than once", key)
+		}
+		obj[key] = value
+	}
+	return nil
+}
+
+// keyByProperty converts the values of same-named nodes to an object keyed by the value of
+// their prop property, which each must have and which must be unique
+func keyByProperty(items []interface{}, prop string) (map[string]interface{}, error) {
+	keyed := make(map[string]interface{}, len(items))
+	for i, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("node %d has no %s property to key by", i, prop)
+		}
+		var key string
+		switch value := obj[prop].(type) {
+		case string:
+			key = value
+		case int64, float64, bool:
+			key = fmt.Sprint(value)
+		case nil:
+			return nil, fmt.Errorf("node %d has no %s property to key by", i, prop)
+		default:
+			return nil, fmt.Errorf("node %d: cannot key by %s value of type %T", i, prop, value)
+		}
+		if _, exists := keyed[key]; exists {
+			return nil, fmt.Errorf("duplicate %s %q", prop, key)
+		}
+		keyed[key] = obj
+	}
+	return keyed, nil
+}
+
+// propertyNames returns the names of node's properties in sorted order, so properties are
+// always converted (and their errors reported) in the same order
+func propertyNames(node *document.Node) []string {
+	names := make([]string, 0, len(node.Properties))
+	for name := range node.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dedupValues removes structurally equal duplicates from values, preserving first-occurrence order
+func dedupValues(values []interface{}) []interface{} {
+	unique := values[:0]
+	for _, value := range values {
+		duplicate := false
+		for _, kept := range unique {
+			if reflect.DeepEqual(kept, value) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// convertNodeToValue converts a node to its JSON value:
+//
+//	arguments only     null (none), the value (one) or an array (several)
+//	properties         object of named arguments and properties
+//	children           object of named arguments, properties and converted children
+//
+// With -arg-mode named, arguments are always named, so nodes with arguments are always objects.
+// With -collapse-single-child, a node with a single child and nothing else takes the child's value.
+func convertNodeToValue(infos nodeInfos, node *document.Node) (interface{}, error) {
+	if err := checkArgCount(infos, node); err != nil {
+		return nil, err
+	}
+	if maxProperties > 0 && len(node.Properties) > maxProperties {
+		return nil, fmt.Errorf("%d properties exceeds the limit of %d", len(node.Properties), maxProperties)
+	}
+
+	stringifyArgs := matchesKey(stringifyKeys, nodeKey(node))
+	args := make([]interface{}, len(node.Arguments))
+	for i, arg := range node.Arguments {
+		if stringifyArgs {
+			args[i] = stringifyValue(infos, node, arg, i, "")
+			continue
+		}
+		if text, ok := formattedNumber(infos, node, arg, i, ""); ok {
+			args[i] = text
+			continue
+		}
+		value, err := resolveTypedValue(arg, keepTypesArgs)
+		if err == nil && argTypes[i+1] != "" {
+			value, err = coerceValue(value, argTypes[i+1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+		args[i] = value
+	}
+
+	if stableShape && len(args) > 0 {
+		return stableShapeValue(infos, node, args)
+	}
+
+	// Nodes without properties or children keep the bare argument values
+	if bareArguments(node, len(args)) {
+		switch len(args) {
+		case 0:
+			return nil, nil
+		case 1:
+			// A unit on the node, as in (px)width 200, applies to its single value
+			if unitTypes[string(node.Type)] {
+				if quantity, ok := unitValue(string(node.Type), args[0]); ok {
+					return quantity, nil
+				}
+			}
+			return args[0], nil
+		default:
+			return args, nil
+		}
+	}
+
+	// Children numbered from zero without gaps form an array
+	if numericArrays && len(args) == 0 && len(node.Properties) == 0 {
+		if array, ok, err := numericChildArray(infos, node.Children); ok || err != nil {
+			return array, err
+		}
+	}
+
+	// A wrapper around exactly one child takes the child's value. Several children with the
+	// same name would form an array, so those are never collapsed.
+	if collapseSingleChild && len(args) == 0 && len(node.Properties) == 0 && len(node.Children) == 1 {
+		child := node.Children[0]
+		value, err := convertNodeToValue(infos, child)
+		if err != nil {
+			return nil, wrapNodeError(nodeKey(child), err)
+		}
+		return value, nil
+	}
+
+	// Children listed in document order replace the whole value of a node with nothing else,
+	// and otherwise go under a metadata key beside its arguments and properties
+	var childList []interface{}
+	if childrenAsList && len(node.Children) > 0 {
+		list, err := convertChildList(infos, node.Children)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 && len(node.Properties) == 0 {
+			return list, nil
+		}
+		childList = list
+	}
+
+	obj := make(map[string]interface{})
+
+	// Add arguments as configured argument names
+	for i, value := range args {
+		obj[nodeArgName(infos, node, i+1)] = value
+	}
+
+	// Add properties directly (flatten the structure)
+	if err := addProperties(infos, obj, node); err != nil {
+		return nil, err
+	}
+
+	if childList != nil {
+		if err := setMetaKey(obj, "children", childList); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	// Convert children, grouping duplicates the same way as top-level nodes
+	if len(node.Children) > 0 {
+		children, err := convertNodeList(infos, node.Children)
+		if err != nil {
+			return nil, err
+		}
+		for childKey, childValue := range children {
+			if _, ok := obj[childKey]; ok && collapseProperties {
+				return nil, fmt.Errorf("collapsed property %q collides with a property of the node", childKey)
+			}
+			obj[childKey] = childValue
+		}
+	}
+
+	return obj, nil
+}
+
+// bareArguments reports whether node, with argCount arguments, converts to its bare argument
+// value (or array of values) rather than an object
+func bareArguments(node *document.Node, argCount int) bool {
+	if len(node.Properties) > 0 || len(node.Children) > 0 {
+		return false
+	}
+	switch {
+	case argCount == 0:
+		return true
+	case argMode == "named":
+		return false
+	case argsAsObject:
+		return argCount == 1
+	}
+	return true
+}
+
+// convertChildList converts children to {"name", "value"} objects in document order, keeping
+// repeated names as separate entries
+func convertChildList(infos nodeInfos, children []*document.Node) ([]interface{}, error) {
+	list := make([]interface{}, len(children))
+	for i, child := range children {
+		key := nodeKey(child)
+		checkMetaPrefix(key)
+		value, err := convertNodeToValue(infos, child)
+		if err != nil {
+			return nil, wrapNodeError(fmt.Sprintf("%s[%d]", key, i), err)
+		}
+		if value, err = withNodeSource(infos, child, value); err != nil {
+			return nil, wrapNodeError(fmt.Sprintf("%s[%d]", key, i), err)
+		}
+		list[i] = map[string]interface{}{"name": key, "value": value}
+	}
+	return list, nil
+}
+
+// numericChildArray converts children named "0" to "n-1", each appearing once in any order,
+// to an array in index order. It reports false for any other set of names, including numbers
+// not starting at zero, gaps, repeats and leading zeros, which stay object keys.
+func numericChildArray(infos nodeInfos, children []*document.Node) ([]interface{}, bool, error) {
+	if len(children) == 0 {
+		return nil, false, nil
+	}
+	ordered := make([]*document.Node, len(children))
+	for _, child := range children {
+		name := child.Name.ValueString()
+		index, err := strconv.Atoi(name)
+		if err != nil || index < 0 || index >= len(children) || strconv.Itoa(index) != name || ordered[index] != nil {
+			return nil, false, nil
+		}
+		ordered[index] = child
+	}
+
+	array := make([]interface{}, len(ordered))
+	for i, child := range ordered {
+		value, err := convertNodeToValue(infos, child)
+		if err != nil {
+			return nil, false, wrapNodeError(nodeKey(child), err)
+		}
+		array[i] = value
+	}
+	return array, true, nil
+}
+
+// addProperties converts the properties of node into obj
+func addProperties(infos nodeInfos, obj map[string]interface{}, node *document.Node) error {
+	for _, name := range propertyNames(node) {
+		value := node.Properties[name]
+		checkMetaPrefix(name)
+
+		// The parser keeps only the last value of a repeated property
+		if onDuplicateProperty != "last-wins" {
+			values, err := propertyOccurrences(infos, node, name)
+			if err != nil {
+				return fmt.Errorf("property %s: %v", name, err)
+			}
+			if len(values) > 1 {
+				switch onDuplicateProperty {
+				case "error":
+					return fmt.Errorf("property %s is set %d times", name, len(values))
+				case "first-wins":
+					value = values[0]
+				case "array":
+					array := make([]interface{}, len(values))
+					for i, occurrence := range values {
+						if array[i], err = resolveProperty(infos, node, name, occurrence); err != nil {
+							return fmt.Errorf("property %s: %v", name, err)
+						}
+					}
+					obj[name] = array
+					continue
+				}
+			}
+		}
+
+		converted, err := resolveProperty(infos, node, name, value)
+		if err != nil {
+			return fmt.Errorf("property %s: %v", name, err)
+		}
+		obj[name] = converted
+	}
+	return nil
+}
+
+// propertyOccurrences returns the value of every occurrence of property name on node, in
+// source order, by parsing the entries the scanner recorded. It returns nil when node has no
+// source information.
+func propertyOccurrences(infos nodeInfos, node *document.Node, name string) ([]*document.Value, error) {
+	info := infos[node]
+	if info == nil {
+		return nil, nil
+	}
+	entries := info.propEntries[name]
+	values := make([]*document.Value, 0, len(entries))
+	for _, entry := range entries {
+		doc, err := kdl.Parse(strings.NewReader("node " + entry))
+		if err != nil || len(doc.Nodes) != 1 || len(doc.Nodes[0].Properties) != 1 {
+			return nil, fmt.Errorf("cannot read occurrence %q", entry)
+		}
+		for _, value := range doc.Nodes[0].Properties {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// stableShapeValue converts a node with arguments for -stable-shape: the arguments always
+// form an "args" array and the properties a "props" object, and children are added
+// alongside them as usual.
+func stableShapeValue(infos nodeInfos, node *document.Node, args []interface{}) (interface{}, error) {
+	props := make(map[string]interface{})
+	if err := addProperties(infos, props, node); err != nil {
+		return nil, err
+	}
+	obj := map[string]interface{}{"args": args, "props": props}
+
+	if len(node.Children) > 0 {
+		children, err := convertNodeList(infos, node.Children)
+		if err != nil {
+			return nil, err
+		}
+		for childKey, childValue := range children {
+			if childKey == "args" || childKey == "props" {
+				return nil, fmt.Errorf("child node %q conflicts with the -stable-shape %q key", childKey, childKey)
+			}
+			obj[childKey] = childValue
+		}
+	}
+
+	return obj, nil
+}
+
+// resolveValue converts a KDL value for output, rejecting values that JSON can't represent
+func resolveValue(value *document.Value) (interface{}, error) {
+	// Type annotations with a registered resolver take precedence over the default conversion
+	if value != nil && value.Type != "" {
+		if resolver, ok := typeResolvers[string(value.Type)]; ok {
+			resolved, err := resolver(value)
+			if err != nil {
+				return nil, fmt.Errorf("(%s) value: %v", value.Type, err)
+			}
+			return resolved, nil
+		}
+	}
+
+	if failOnUnknownType && value != nil {
+		switch v := value.ResolvedValue().(type) {
+		case string, int64, float64, bool, nil:
+		default:
+			return nil, fmt.Errorf("unsupported value type %T for %s", v, value.String())
+		}
+	}
+
+	resolved := convertValue(value)
+
+	if f, ok := resolved.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		if allowNonFinite {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("non-finite number %v cannot be represented in JSON (use -allow-nonfinite to emit null)", f)
+	}
+
+	return resolved, nil
+}
+
+// resolveProperty resolves the value of property name of node, honoring -stringify and
+// -preserve-number-format
+func resolveProperty(infos nodeInfos, node *document.Node, name string, value *document.Value) (interface{}, error) {
+	if matchesKey(stringifyKeys, name) {
+		return stringifyValue(infos, node, value, -1, name), nil
+	}
+	if text, ok := formattedNumber(infos, node, value, -1, name); ok {
+		return text, nil
+	}
+	return resolveTypedValue(value, keepTypesProps)
+}
+
+// stringifyValue returns value, argument index or property name of node, as a string for
+// -stringify: strings as they are and numbers as written in the KDL (1.0 stays "1.0", 1e3
+// stays "1e3"). Other values are formatted by the parser, and nulls stay null.
+func stringifyValue(infos nodeInfos, node *document.Node, value *document.Value, index int, name string) interface{} {
+	if value == nil || value.Value == nil {
+		return nil
+	}
+	if s, ok := value.Value.(string); ok {
+		return s
+	}
+	switch value.Value.(type) {
+	case int64, float64, *big.Int, *big.Float:
+		if text := sourceText(infos, node, index, name); text != "" {
+			return text
+		}
+	}
+	return strings.TrimPrefix(value.String(), "("+string(value.Type)+")")
+}
+
+// sourceText returns the source text, without any type annotation, of argument index of node
+// or, when index is negative, of its property name. It is empty when the text isn't known.
+func sourceText(infos nodeInfos, node *document.Node, index int, name string) string {
+	info := infos[node]
+	if info == nil {
+		return ""
+	}
+	if index >= 0 {
+		if len(info.args) == len(node.Arguments) {
+			return info.args[index]
+		}
+		return ""
+	}
+	return info.props[name]
+}
+
+// formattedNumber returns the source text of a number written in hex, octal or binary or with
+// _ separators, for -preserve-number-format. The value is argument index of node, or its
+// property name when index is negative. Plain decimal numbers are not formatted.
+func formattedNumber(infos nodeInfos, node *document.Node, value *document.Value, index int, name string) (string, bool) {
+	if !preserveNumberFormat || value == nil {
+		return "", false
+	}
+	if _, resolved := typeResolvers[string(value.Type)]; resolved && value.Type != "" {
+		return "", false
+	}
+	switch value.Value.(type) {
+	case int64, float64, *big.Int, *big.Float:
+	default:
+		return "", false
+	}
+
+	// The parser drops underscores, so the text comes from the source when available
+	text := sourceText(infos, node, index, name)
+	if text == "" {
+		switch value.Flag {
+		case document.FlagHexadecimal, document.FlagOctal, document.FlagBinary:
+			text = strings.TrimPrefix(value.String(), "("+string(value.Type)+")")
+		}
+	}
+
+	digits := strings.TrimLeft(text, "+-")
+	if strings.Contains(text, "_") || strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0o") || strings.HasPrefix(digits, "0b") {
+		return text, true
+	}
+	return "", false
+}
+
+// unitValue returns v with its unit as a {"value", "unit"} object when v is a number
+func unitValue(unit string, v interface{}) (map[string]interface{}, bool) {
+	switch v.(type) {
+	case int64, float64:
+		return map[string]interface{}{"value": v, "unit": unit}, true
+	}
+	return nil, false
+}
+
+// resolveTypedValue resolves value and, when keepType is set, wraps annotated values as
+// {"type": ..., "value": ...} so the annotation survives conversion.
+// Values consumed by a type resolver are not wrapped, and numbers annotated with a -units type
+// become {"value": ..., "unit": ...} instead.
+// With -with-raw, every value is wrapped and the wrapper also carries the KDL source text.
+func resolveTypedValue(value *document.Value, keepType bool) (interface{}, error) {
+	resolved, err := resolveValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapper map[string]interface{}
+	if value != nil && unitTypes[string(value.Type)] {
+		if quantity, ok := unitValue(string(value.Type), resolved); ok {
+			wrapper = quantity
+		}
+	}
+	if wrapper == nil && keepType && value != nil && value.Type != "" {
+		if _, resolvedByType := typeResolvers[string(value.Type)]; !resolvedByType {
+			// The annotation moves to "type", so a string value is the bare string
+			if s, ok := value.Value.(string); ok {
+				resolved = s
+			}
+			wrapper = map[string]interface{}{
+				"type":  string(value.Type),
+				"value": resolved,
+			}
+		}
+	}
+
+	if withRaw && value != nil {
+		if wrapper == nil {
+			wrapper = map[string]interface{}{"value": resolved}
+		}
+		wrapper["raw"] = value.String()
+	}
+
+	if wrapper != nil {
+		return wrapper, nil
+	}
+	return resolved, nil
+}
+
+// registerTypeResolver makes values annotated with typeName convert through resolver
+func registerTypeResolver(typeName string, resolver typeResolver) {
+	typeResolvers[typeName] = resolver
+}
+
+// applyResolverMappings registers the built-in resolvers named by TYPE=RESOLVER mappings
+func applyResolverMappings(mappings []string) error {
+	for _, mapping := range mappings {
+		typeName, name, ok := strings.Cut(mapping, "=")
+		if !ok || typeName == "" {
+			return fmt.Errorf("invalid -resolver %q (expected TYPE=RESOLVER)", mapping)
+		}
+		resolver, exists := builtinResolvers[name]
+		if !exists {
+			return fmt.Errorf("unknown resolver %q (available: duration, date-time, date)", name)
+		}
+		registerTypeResolver(typeName, resolver)
+	}
+	return nil
+}
+
+// resolveDuration converts a Go duration string such as "1h30m" into seconds
+func resolveDuration(value *document.Value) (interface{}, error) {
+	text, ok := value.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a duration string, got %s", value.String())
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, err
+	}
+	return duration.Seconds(), nil
+}
+
+// resolveDateTime converts an RFC 3339 timestamp into Unix seconds
+func resolveDateTime(value *document.Value) (interface{}, error) {
+	text, ok := value.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a date-time string, got %s", value.String())
+	}
+	timestamp, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return nil, err
+	}
+	return timestamp.Unix(), nil
+}
+
+// resolveDate converts a YYYY-MM-DD date into Unix seconds at midnight UTC
+func resolveDate(value *document.Value) (interface{}, error) {
+	text, ok := value.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a date string, got %s", value.String())
+	}
+	date, err := time.Parse("2006-01-02", text)
+	if err != nil {
+		return nil, err
+	}
+	return date.Unix(), nil
+}
+
+// applyArgTypeMappings parses "INDEX=TYPE" coercions into argTypes
+func applyArgTypeMappings(mappings []string) error {
+	for _, mapping := range mappings {
+		indexText, typeName, ok := strings.Cut(mapping, "=")
+		index, err := strconv.Atoi(indexText)
+		if !ok || err != nil || index < 1 {
+			return fmt.Errorf("invalid -arg-type %q (expected N=TYPE with N >= 1)", mapping)
+		}
+		switch typeName {
+		case "string", "int", "float", "bool":
+			argTypes[index] = typeName
+		default:
+			return fmt.Errorf("unknown argument type %q (available: string, int, float, bool)", typeName)
+		}
+	}
 	return nil
 }
 
+// coerceValue converts a resolved value to the named JSON type, failing if it has no sensible equivalent
+func coerceValue(v interface{}, typeName string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	// Coerce the value inside -keep-types and -with-raw wrappers
+	if wrapper, ok := v.(map[string]interface{}); ok {
+		coerced, err := coerceValue(wrapper["value"], typeName)
+		if err != nil {
+			return nil, err
+		}
+		wrapper["value"] = coerced
+		return wrapper, nil
+	}
+
+	switch typeName {
+	case "string":
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case int64:
+			return strconv.FormatInt(x, 10), nil
+		case float64:
+			return strconv.FormatFloat(x, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		}
+	case "int":
+		switch x := v.(type) {
+		case int64:
+			return x, nil
+		case float64:
+			if x == math.Trunc(x) && math.Abs(x) < 1<<63 {
+				return int64(x), nil
+			}
+		case string:
+			if n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64); err == nil {
+				return n, nil
+			}
+		}
+	case "float":
+		switch x := v.(type) {
+		case float64:
+			return x, nil
+		case int64:
+			return float64(x), nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+				return f, nil
+			}
+		}
+	case "bool":
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case string:
+			if x == "true" || x == "false" {
+				return x == "true", nil
+			}
+		}
+	}
+
+	if s, ok := v.(string); ok {
+		return nil, fmt.Errorf("cannot convert %q to %s", s, typeName)
+	}
+	return nil, fmt.Errorf("cannot convert %v to %s", v, typeName)
+}
+
+// normalizeBool converts exactly "true"/"false" (and "yes"/"no" with -normalize-yes-no) to a
+// boolean, returning any other string unchanged
+func normalizeBool(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "yes", "no":
+		if normalizeYesNo {
+			return s == "yes"
+		}
+	}
+	return s
+}
+
 func convertValue(value *document.Value) interface{} {
 	if value == nil {
 		return nil
 	}
 
+	// Annotated strings keep their annotation, as in "(rgb)ff0000", from ResolvedValue below
+	if s, ok := value.Value.(string); ok && value.Type == "" {
+		if normalizeBools {
+			return normalizeBool(s)
+		}
+		return s
+	}
+
 	resolved := value.ResolvedValue()
 	switch v := resolved.(type) {
 	case string:
@@ -270,3 +5766,368 @@ func convertValue(value *document.Value) interface{} {
 		return value.String()
 	}
 }
+
+// nodeInfo describes where a node appears in the include-expanded source text
+type nodeInfo struct {
+	line          int                       // 1-based line of the node name
+	column        int                       // 1-based column of the node name
+	comment       string                    // text of a // comment on the node's first line
+	source        string                    // file of a top-level node, set for -with-source
+	location      string                    // file:line of the node, set for errors that report it
+	args          []string                  // source text of each argument, without type annotations
+	props         map[string]string         // source text of each property value, without type annotations
+	propEntries   map[string][]string       // source text of every name=value entry of each property, in order
+	argPositions  []sourcePosition          // where each argument starts
+	propPositions map[string]sourcePosition // where the last occurrence of each property starts
+	doc           string                    // text of the // comment lines directly above the node
+	argNames      []string                  // argument names from the @argnames directive in scope
+	start         int                       // byte offset where the node (including its type annotation) starts
+	end           int                       // byte offset just past the node
+	children      []*nodeInfo
+}
+
+// sourcePosition is a 1-based line and column in the scanned source
+type sourcePosition struct {
+	line   int
+	column int
+}
+
+// nodeInfos maps parsed nodes to their scanned source information, which the KDL parser
+// doesn't expose. Nodes without an entry (and every node, for a nil map) have none.
+type nodeInfos map[*document.Node]*nodeInfo
+
+// matchNodeInfo pairs the scanned infos with the parsed nodes, level by level. Levels where
+// the scanner and parser disagree on the number of nodes are left unannotated.
+func matchNodeInfo(nodes []*document.Node, scanned []*nodeInfo) nodeInfos {
+	infos := make(nodeInfos)
+	infos.add(nodes, scanned)
+	return infos
+}
+
+// add records scanned as the information of nodes and, recursively, their children
+func (infos nodeInfos) add(nodes []*document.Node, scanned []*nodeInfo) {
+	if len(nodes) != len(scanned) {
+		return
+	}
+	for i, node := range nodes {
+		infos[node] = scanned[i]
+		infos.add(node.Children, scanned[i].children)
+	}
+}
+
+// sourceScanner is a minimal KDL lexer that locates nodes and their comments
+type sourceScanner struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+// scanNodes returns the position and comment information of every node in src, mirroring the
+// node tree the parser produces. Nodes commented out with /- are skipped.
+func scanNodes(src string) []*nodeInfo {
+	s := &sourceScanner{src: strings.TrimPrefix(src, "\ufeff"), line: 1, col: 1}
+	return s.scanBlock(nil, false)
+}
+
+func (s *sourceScanner) eof() bool {
+	return s.pos >= len(s.src)
+}
+
+func (s *sourceScanner) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(s.src[s.pos:], prefix)
+}
+
+// advance consumes one character, tracking line and column
+func (s *sourceScanner) advance() {
+	if s.eof() {
+		return
+	}
+	if s.src[s.pos] == '\n' {
+		s.line++
+		s.col = 1
+		s.pos++
+		return
+	}
+	_, size := utf8.DecodeRuneInString(s.src[s.pos:])
+	s.pos += size
+	s.col++
+}
+
+func isNewline(c byte) bool {
+	return c == '\n' || c == '\r'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// scanBlock scans nodes until the end of the enclosing children block (or the end of input)
+func (s *sourceScanner) scanBlock(parent *nodeInfo, nested bool) []*nodeInfo {
+	var nodes []*nodeInfo
+
+	// Consecutive comment lines, documenting the next node if it directly follows them
+	var docLines []string
+	docEnd := 0
+
+	for !s.eof() {
+		c := s.src[s.pos]
+		switch {
+		case isSpace(c) || isNewline(c) || c == ';':
+			s.advance()
+		case s.hasPrefix("//"):
+			line := s.line
+			text := s.readLineComment()
+			switch {
+			case parent != nil && line == parent.line:
+				if parent.comment == "" {
+					parent.comment = text
+				}
+			case len(nodes) > 0 && line == nodes[len(nodes)-1].line:
+				// A trailing comment after "node;" belongs to that node
+			default:
+				if line != docEnd+1 {
+					docLines = nil
+				}
+				docLines = append(docLines, text)
+				docEnd = line
+			}
+		case s.hasPrefix("/*"):
+			s.skipBlockComment()
+		case s.hasPrefix("/-"):
+			s.advance()
+			s.advance()
+			s.skipSpace()
+			s.scanNode()
+		case c == '}':
+			s.advance()
+			if nested {
+				return nodes
+			}
+		default:
+			info := s.scanNode()
+			info.end = s.pos
+			if docLines != nil && docEnd == info.line-1 {
+				info.doc = strings.Join(docLines, "\n")
+			}
+			docLines = nil
+			nodes = append(nodes, info)
+		}
+	}
+	return nodes
+}
+
+// scanNode scans a single node, starting at its (optional) type annotation
+func (s *sourceScanner) scanNode() *nodeInfo {
+	start := s.pos
+	if !s.eof() && s.src[s.pos] == '(' {
+		s.skipAnnotation()
+	}
+
+	info := &nodeInfo{line: s.line, column: s.col, start: start}
+	s.skipToken()
+
+	for !s.eof() {
+		c := s.src[s.pos]
+		switch {
+		case isNewline(c) || c == ';':
+			s.advance()
+			return info
+		case c == '}':
+			// End of the parent's children block; leave it for scanBlock
+			return info
+		case isSpace(c):
+			s.advance()
+		case c == '\\':
+			// Line continuation: skip to the start of the next line
+			s.advance()
+			for !s.eof() && !isNewline(s.src[s.pos]) {
+				if s.hasPrefix("//") {
+					s.readLineComment()
+					break
+				}
+				s.advance()
+			}
+			s.advance()
+		case s.hasPrefix("//"):
+			line := s.line
+			text := s.readLineComment()
+			if line == info.line && info.comment == "" {
+				info.comment = text
+			}
+		case s.hasPrefix("/*"):
+			s.skipBlockComment()
+		case s.hasPrefix("/-"):
+			s.advance()
+			s.advance()
+			s.skipSpace()
+			if !s.eof() && s.src[s.pos] == '{' {
+				s.advance()
+				s.scanBlock(nil, true)
+			} else {
+				s.skipEntry()
+			}
+		case c == '{':
+			s.advance()
+			info.children = s.scanBlock(info, true)
+		default:
+			start := s.pos
+			position := sourcePosition{line: s.line, column: s.col}
+			key, value := s.skipEntry()
+			if key == "" {
+				info.args = append(info.args, value)
+				info.argPositions = append(info.argPositions, position)
+				break
+			}
+			if unquoted, err := strconv.Unquote(key); err == nil {
+				key = unquoted
+			}
+			if info.props == nil {
+				info.props = make(map[string]string)
+				info.propEntries = make(map[string][]string)
+				info.propPositions = make(map[string]sourcePosition)
+			}
+			info.propPositions[key] = position
+			info.props[key] = value
+			info.propEntries[key] = append(info.propEntries[key], s.src[start:s.pos])
+		}
+	}
+	return info
+}
+
+func (s *sourceScanner) skipSpace() {
+	for !s.eof() && isSpace(s.src[s.pos]) {
+		s.advance()
+	}
+}
+
+// skipEntry skips an argument or property, including type annotations. It returns the source
+// text of a property's name (empty for arguments) and of the value without its annotation.
+func (s *sourceScanner) skipEntry() (key, value string) {
+	if s.src[s.pos] == '(' {
+		s.skipAnnotation()
+	}
+	start := s.pos
+	s.skipToken()
+	if !s.eof() && s.src[s.pos] == '=' {
+		key = s.src[start:s.pos]
+		s.advance()
+		if !s.eof() && s.src[s.pos] == '(' {
+			s.skipAnnotation()
+		}
+		start = s.pos
+		s.skipToken()
+	}
+	return key, s.src[start:s.pos]
+}
+
+// skipAnnotation skips a (type) annotation
+func (s *sourceScanner) skipAnnotation() {
+	s.advance()
+	for !s.eof() && s.src[s.pos] != ')' {
+		if s.src[s.pos] == '"' {
+			s.skipString()
+			continue
+		}
+		s.advance()
+	}
+	s.advance()
+}
+
+// skipToken skips a string, raw string or bare identifier/number
+func (s *sourceScanner) skipToken() {
+	if s.eof() {
+		return
+	}
+	if s.src[s.pos] == '"' {
+		s.skipString()
+		return
+	}
+	if s.src[s.pos] == 'r' {
+		hashes := 0
+		for s.pos+1+hashes < len(s.src) && s.src[s.pos+1+hashes] == '#' {
+			hashes++
+		}
+		if s.pos+1+hashes < len(s.src) && s.src[s.pos+1+hashes] == '"' {
+			s.skipRawString(hashes)
+			return
+		}
+	}
+
+	start := s.pos
+	for !s.eof() {
+		c := s.src[s.pos]
+		if isSpace(c) || isNewline(c) || strings.IndexByte(`{}();=/\"`, c) >= 0 {
+			break
+		}
+		s.advance()
+	}
+	if s.pos == start {
+		// Unexpected character; consume it so scanning always makes progress
+		s.advance()
+	}
+}
+
+// skipString skips a quoted string, honouring backslash escapes
+func (s *sourceScanner) skipString() {
+	s.advance()
+	for !s.eof() {
+		switch s.src[s.pos] {
+		case '\\':
+			s.advance()
+			s.advance()
+		case '"':
+			s.advance()
+			return
+		default:
+			s.advance()
+		}
+	}
+}
+
+// skipRawString skips a raw string r#"..."# with the given number of hashes
+func (s *sourceScanner) skipRawString(hashes int) {
+	for i := 0; i < hashes+2; i++ {
+		s.advance()
+	}
+	terminator := "\"" + strings.Repeat("#", hashes)
+	for !s.eof() && !s.hasPrefix(terminator) {
+		s.advance()
+	}
+	for i := 0; i < len(terminator) && !s.eof(); i++ {
+		s.advance()
+	}
+}
+
+// skipBlockComment skips a (possibly nested) /* */ comment
+func (s *sourceScanner) skipBlockComment() {
+	depth := 0
+	for !s.eof() {
+		switch {
+		case s.hasPrefix("/*"):
+			depth++
+			s.advance()
+			s.advance()
+		case s.hasPrefix("*/"):
+			depth--
+			s.advance()
+			s.advance()
+			if depth == 0 {
+				return
+			}
+		default:
+			s.advance()
+		}
+	}
+}
+
+// readLineComment consumes a // comment up to (not including) the end of the line and returns its text
+func (s *sourceScanner) readLineComment() string {
+	s.advance()
+	s.advance()
+	start := s.pos
+	for !s.eof() && !isNewline(s.src[s.pos]) {
+		s.advance()
+	}
+	return strings.TrimSpace(s.src[start:s.pos])
+}